@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxBatchItems = 500
+	batchWorkers  = 4
+
+	// batchItemTimeout extends the write deadline of a batch response
+	// after every item
+	batchItemTimeout = time.Second * 30
+)
+
+// batchRequest contains the parameters of a /batch call
+type batchRequest struct {
+	Items []*batchItem `json:"items"`
+}
+
+// batchItem is either a /weighted or a /bounded request
+type batchItem struct {
+	Weighted *weightedRequest `json:"weighted,omitempty"`
+	Bounded  *boundedRequest  `json:"bounded,omitempty"`
+}
+
+// batchResult is written for every item in the order they complete
+type batchResult struct {
+	Index int `json:"index"`
+	response
+}
+
+func (item *batchItem) validate() *requestError {
+	switch {
+	case item.Weighted != nil && item.Bounded != nil:
+		return &requestError{"conflicting_items", "", "Only one of weighted or bounded is allowed"}
+	case item.Weighted != nil:
+		if err := item.Weighted.validate(); err != nil {
+			err.Field = "weighted." + err.Field
+			return err
+		}
+	case item.Bounded != nil:
+		if err := item.Bounded.validate(); err != nil {
+			err.Field = "bounded." + err.Field
+			return err
+		}
+	default:
+		return &requestError{"required", "", "Either weighted or bounded is required"}
+	}
+
+	return nil
+}
+
+// attach resolves the files of the item that refer to uploaded files
+func (item *batchItem) attach(form *multipart.Form) {
+	var sources []*fileSource
+	if item.Weighted != nil {
+		sources = append(sources, item.Weighted.Image, item.Weighted.Font, item.Weighted.Mask)
+	}
+
+	if item.Bounded != nil {
+		sources = append(sources, item.Bounded.Image)
+	}
+
+	for _, source := range sources {
+		if source == nil || source.File == "" || form == nil {
+			continue
+		}
+
+		if headers := form.File[source.File]; len(headers) != 0 {
+			source.header = headers[0]
+		}
+	}
+}
+
+func (item *batchItem) run(ctx context.Context) (interface{}, *requestError) {
+	if err := item.validate(); err != nil {
+		return nil, err
+	}
+
+	entry := getRequestLog(ctx)
+	if item.Weighted != nil {
+		entry.setRequest(item.Weighted.Image, item.Weighted.params())
+	} else {
+		entry.setRequest(item.Bounded.Image, item.Bounded.rects())
+	}
+
+	var msg interface{}
+	var herr *handlerError
+	if item.Weighted != nil {
+		msg, herr = runWeighted(ctx, item.Weighted, nil)
+	} else {
+		msg, herr = runBounded(ctx, item.Bounded.Image, item.Bounded.rects())
+	}
+
+	if herr != nil {
+		return nil, herr.requestError()
+	}
+
+	return msg, nil
+}
+
+// getBatchRequest reads the items from a JSON body or from the items field
+// of a multipart form
+func getBatchRequest(r *http.Request) (*batchRequest, *requestError) {
+	req := &batchRequest{}
+	if isJSONRequest(r) {
+		if err := decodeJSONRequest(r, req); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.ParseMultipartForm(cfg.MaxFormSize); err != nil {
+			var merr *http.MaxBytesError
+			if errors.As(err, &merr) {
+				return nil, bodyError("", err)
+			}
+
+			return nil, &requestError{"invalid_body", "", "Expected a JSON body or a multipart form"}
+		}
+
+		if err := json.Unmarshal([]byte(r.FormValue("items")), &req.Items); err != nil {
+			return nil, &requestError{"invalid_json", "items", "Invalid JSON: " + err.Error()}
+		}
+
+		for _, item := range req.Items {
+			if item != nil {
+				item.attach(r.MultipartForm)
+			}
+		}
+	}
+
+	switch {
+	case len(req.Items) == 0:
+		return nil, &requestError{"too_few_items", "items", "At least 1 item is required"}
+	case len(req.Items) > maxBatchItems:
+		return nil, &requestError{"too_many_items", "items", fmt.Sprintf("At most %d items are allowed", maxBatchItems)}
+	}
+
+	return req, nil
+}
+
+func serveBatch(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxFormSize)
+	defer r.Body.Close()
+
+	req, rerr := getBatchRequest(r)
+	if rerr != nil {
+		return rejectRequest(w, rerr)
+	}
+
+	jobs := make(chan int)
+	results := make(chan *batchResult)
+	var wg sync.WaitGroup
+
+	for i := 0; i < batchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := &batchResult{Index: i}
+				if req.Items[i] == nil {
+					res.Error = &requestError{"required", "", "Either weighted or bounded is required"}
+				} else {
+					// Items are logged separately from the request
+					entry := &requestLog{id: getRequestLog(r.Context()).id, rects: -1}
+					ctx, cancel := processContext(withRequestLog(r.Context(), entry))
+					res.Msg, res.Error = req.Items[i].run(ctx)
+					cancel()
+					logBatchItem(ctx, i, entry, res.Error)
+				}
+
+				results <- res
+			}
+		}()
+	}
+
+	go func() {
+		for i := range req.Items {
+			jobs <- i
+		}
+
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for res := range results {
+		// Keep draining results after a failed write so no worker blocks
+		if err != nil {
+			continue
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(batchItemTimeout))
+		if err = enc.Encode(res); err == nil {
+			rc.Flush()
+		}
+	}
+
+	return
+}
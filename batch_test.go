@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// batchImage returns a png with a calm area above and below a line
+func batchImage(t *testing.T) []byte {
+	img := image.NewGray(image.Rect(0, 0, 120, 80))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+
+	for x := 0; x < 120; x++ {
+		img.SetGray(x, 40, color.Gray{})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// batchLine is a line of a /batch response
+type batchLine struct {
+	Index *int            `json:"index"`
+	Msg   json.RawMessage `json:"msg"`
+	Error *requestError   `json:"error"`
+}
+
+// rects returns the amount of rectangles of a /weighted or /bounded result
+func (line *batchLine) rects() int {
+	var weighted struct {
+		Rects []json.RawMessage `json:"rects"`
+	}
+
+	if err := json.Unmarshal(line.Msg, &weighted); err == nil {
+		return len(weighted.Rects)
+	}
+
+	var bounded []json.RawMessage
+	json.Unmarshal(line.Msg, &bounded)
+	return len(bounded)
+}
+
+// readBatch decodes the lines of w by index, every index up to n has to
+// be answered exactly once
+func readBatch(t *testing.T, w *httptest.ResponseRecorder, n int) []*batchLine {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %q, want application/x-ndjson", ct)
+	}
+
+	lines := make([]*batchLine, n)
+	for _, text := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		line := &batchLine{}
+		if err := json.Unmarshal([]byte(text), line); err != nil {
+			t.Fatalf("Line %q: %v", text, err)
+		}
+
+		if line.Index == nil || *line.Index < 0 || *line.Index >= n {
+			t.Fatalf("Line %q has no valid index", text)
+		}
+
+		if lines[*line.Index] != nil {
+			t.Fatalf("Item %d is answered twice", *line.Index)
+		}
+
+		lines[*line.Index] = line
+	}
+
+	for i, line := range lines {
+		if line == nil {
+			t.Fatalf("Item %d is not answered: %s", i, w.Body.String())
+		}
+	}
+
+	return lines
+}
+
+// checkItem compares the result of an item to the amount of rectangles or
+// the error code it should have
+func checkItem(t *testing.T, i int, line *batchLine, rects int, code string) {
+	t.Helper()
+	if code != "" {
+		if line.Error == nil || line.Error.Code != code {
+			t.Errorf("Item %d: got %+v, want %s", i, line.Error, code)
+		}
+
+		return
+	}
+
+	if line.Error != nil || line.rects() != rects {
+		t.Errorf("Item %d: got %s %+v, want %d rectangles", i, line.Msg, line.Error, rects)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	img := batchImage(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(img)
+	}))
+	defer srv.Close()
+
+	defer func(old *fetcher) { defaultFetcher = old }(defaultFetcher)
+	defaultFetcher = testFetcher()
+	defaultFetcher.MaxSize = int64(len(img))
+
+	weighted := func(source map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"weighted": map[string]interface{}{"image": source, "w": 10, "h": 10, "n": 2},
+		}
+	}
+
+	// More items than workers, so several run at once
+	tests := []struct {
+		item  interface{}
+		rects int
+		code  string
+	}{
+		{weighted(map[string]interface{}{"base64": img}), 2, ""},
+		{weighted(map[string]interface{}{"base64": []byte("not an image")}), 0, "not_an_image"},
+		{weighted(map[string]interface{}{"url": srv.URL + "/image"}), 2, ""},
+		{weighted(map[string]interface{}{"url": srv.URL + "/missing"}), 0, "upstream_status"},
+		{map[string]interface{}{
+			"bounded": map[string]interface{}{"image": map[string]interface{}{"base64": img}, "bounds": [][]int{{0, 0, 60, 40}, {60, 40, 120, 80}}},
+		}, 2, ""},
+		{nil, 0, "required"},
+		{map[string]interface{}{}, 0, "required"},
+		{weighted(map[string]interface{}{"base64": img}), 2, ""},
+		{weighted(map[string]interface{}{"url": srv.URL + "/image"}), 2, ""},
+		{weighted(nil), 0, "required"},
+	}
+
+	items := make([]interface{}, len(tests))
+	for i, test := range tests {
+		items[i] = test.item
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/batch", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	lines := readBatch(t, serve(r), len(tests))
+	for i, test := range tests {
+		checkItem(t, i, lines[i], test.rects, test.code)
+	}
+}
+
+func TestBatchItemLimits(t *testing.T) {
+	for _, n := range []int{0, maxBatchItems + 1} {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = `{"bounded": {"image": {"url": "http://example.com/image.png"}, "bounds": [[0, 0, 1, 1]]}}`
+		}
+
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(`{"items": [`+strings.Join(items, ",")+`]}`))
+		r.Header.Set("Content-Type", "application/json")
+
+		code := "too_few_items"
+		if n > 0 {
+			code = "too_many_items"
+		}
+
+		checkError(t, serve(r), http.StatusNotAcceptable, code)
+	}
+}
+
+func TestBatchMultipart(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	items := []string{
+		`{"weighted": {"image": {"file": "first"}, "w": 10, "h": 10, "n": 2}}`,
+		`{"bounded": {"image": {"file": "first"}, "bounds": [[0, 0, 60, 40], [60, 40, 120, 80]]}}`,
+		`{"weighted": {"image": {"file": "second"}, "w": 10, "h": 10, "n": 1}}`,
+		`{"weighted": {"image": {"file": "missing"}, "w": 10, "h": 10}}`,
+	}
+
+	if err := form.WriteField("items", "["+strings.Join(items, ",")+"]"); err != nil {
+		t.Fatal(err)
+	}
+
+	img := batchImage(t)
+	for _, name := range []string{"first", "second"} {
+		part, err := form.CreateFormFile(name, name+".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		part.Write(img)
+	}
+
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/batch", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	lines := readBatch(t, serve(r), len(items))
+	for i, rects := range []int{2, 2, 1} {
+		checkItem(t, i, lines[i], rects, "")
+	}
+
+	checkItem(t, 3, lines[3], 0, "unreadable_file")
+
+	// The items field has to be valid JSON
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	form.WriteField("items", "[")
+	form.Close()
+
+	r = httptest.NewRequest("POST", "/batch", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := serve(r)
+	checkError(t, w, http.StatusNotAcceptable, "invalid_json")
+	if !strings.Contains(w.Body.String(), `"field":"items"`) {
+		t.Errorf("Body %s, want the error on items", w.Body.String())
+	}
+}
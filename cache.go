@@ -0,0 +1,388 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheMaxAge is sent in the Cache-Control header of cacheable responses
+const cacheMaxAge = time.Hour * 24
+
+// responseVersion is raised when the format of cached responses changes,
+// so results cached on disk in the old format are not served
+const responseVersion = 2
+
+// resultCache stores encoded responses by key
+type resultCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// results caches the responses of /weighted and /bounded, it is nil when
+// caching is disabled
+var results resultCache
+
+// lruCache keeps the most recently used entries in memory
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key, value})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*lruEntry).key)
+	}
+}
+
+// diskCache stores every entry as a file in dir. When the files grow larger
+// than maxSize bytes the least recently used ones are removed.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// newDiskCache creates a cache in dir, which is created when missing. The
+// entries already in dir count towards maxSize.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{dir: dir, maxSize: maxSize}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		c.size += e.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// entries returns the files in the cache, least recently used first
+func (c *diskCache) entries() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := files[:0]
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			entries = append(entries, f)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	return entries, nil
+}
+
+// evict removes the least recently used entries until the cache is at
+// most maxSize, c.mu has to be held
+func (c *diskCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if c.size <= c.maxSize {
+			break
+		}
+
+		if os.Remove(filepath.Join(c.dir, e.Name())) == nil {
+			c.size -= e.Size()
+		}
+	}
+}
+
+func (c *diskCache) Get(key string) ([]byte, bool) {
+	path := filepath.Join(c.dir, key)
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	// The modification time orders the entries for eviction
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return value, true
+}
+
+func (c *diskCache) Set(key string, value []byte) {
+	if int64(len(value)) > c.maxSize {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return
+	}
+
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := filepath.Join(c.dir, key)
+	var replaced int64
+	if info, serr := os.Stat(path); serr == nil {
+		replaced = info.Size()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.size += int64(len(value)) - replaced
+	c.evict()
+}
+
+// tieredCache looks up entries in memory before looking them up on disk
+type tieredCache struct {
+	memory *lruCache
+	disk   *diskCache
+}
+
+func (c *tieredCache) Get(key string) ([]byte, bool) {
+	if value, ok := c.memory.Get(key); ok {
+		return value, true
+	}
+
+	value, ok := c.disk.Get(key)
+	if ok {
+		c.memory.Set(key, value)
+	}
+
+	return value, ok
+}
+
+func (c *tieredCache) Set(key string, value []byte) {
+	c.memory.Set(key, value)
+	c.disk.Set(key, value)
+}
+
+// newResultCache creates an in memory cache of size entries, backed by
+// at most dirSize bytes in dir if it is not empty. It returns nil if size
+// is 0.
+func newResultCache(size int, dir string, dirSize int64) (resultCache, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+
+	memory := newLRUCache(size)
+	if dir == "" {
+		return memory, nil
+	}
+
+	disk, err := newDiskCache(dir, dirSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tieredCache{memory, disk}, nil
+}
+
+// cacheSettings are the settings of the server that change results. They
+// are part of every key, so a cache directory shared by servers with other
+// settings or builds does not serve their results.
+type cacheSettings struct {
+	// Version is the responseVersion of the server
+	Version          int
+	Backend          string
+	MaxImageSize     int
+	SoftMaxThreshold float64
+	MaxThreshold     float64
+	// FaceCascade is the hash of the -facecascade file, empty for the
+	// bundled cascade
+	FaceCascade string
+}
+
+// resultSettings are the settings of this server, set by config.apply
+var resultSettings cacheSettings
+
+// cacheKey hashes the settings of the server, the kind of request, its
+// normalized parameters and the contents of its files, which are loaded
+// until ctx is done
+func cacheKey(ctx context.Context, kind string, params interface{}, files ...*fileSource) (string, error) {
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(&resultSettings); err != nil {
+		return "", err
+	}
+
+	h.Write([]byte(kind))
+	if err := json.NewEncoder(h).Encode(params); err != nil {
+		return "", err
+	}
+
+	for _, f := range files {
+		if f == nil {
+			h.Write([]byte{0})
+			continue
+		}
+
+		data, err := f.load(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		sum := sha256.Sum256(data)
+		h.Write(sum[:])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// notModified reports whether the If-None-Match header of r matches etag
+func notModified(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetched reports whether any of files is fetched from a url
+func fetched(files ...*fileSource) bool {
+	for _, f := range files {
+		if f != nil && f.URL != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveCached writes the response for key from the cache or, when it is
+// missing, the response created by run. Responses are only cached when run
+// succeeds. Clients have to revalidate responses to fetched files, which
+// can change upstream.
+func serveCached(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	revalidate bool,
+	run func() (interface{}, *handlerError),
+) (int, error) {
+	etag := strconv.Quote(key)
+	if notModified(r, etag) {
+		setCacheHeaders(w, etag, revalidate)
+		w.WriteHeader(http.StatusNotModified)
+		return 0, nil
+	}
+
+	if results != nil {
+		if body, ok := results.Get(key); ok {
+			setCacheHeaders(w, etag, revalidate)
+			w.Write(body)
+			return 0, nil
+		}
+	}
+
+	msg, herr := run()
+	if herr != nil {
+		return writeHandlerError(w, herr)
+	}
+
+	body, err := json.Marshal(&response{Msg: msg})
+	if err != nil {
+		return 0, err
+	}
+
+	body = append(body, '\n')
+	if results != nil {
+		results.Set(key, body)
+	}
+
+	setCacheHeaders(w, etag, revalidate)
+	_, err = w.Write(body)
+	return 0, err
+}
+
+func setCacheHeaders(w http.ResponseWriter, etag string, revalidate bool) {
+	w.Header().Set("ETag", etag)
+	if revalidate {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(cacheMaxAge.Seconds())))
+}
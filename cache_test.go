@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("x"), 10)
+	c.Set("a", value)
+	c.Set("b", value)
+
+	// b was used least recently
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "b"), old, old)
+	c.Set("c", value)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Entry %s cached: %t, want %t", key, ok, want)
+		}
+	}
+
+	c.Set("large", bytes.Repeat([]byte("x"), 30))
+	if _, ok := c.Get("large"); ok {
+		t.Error("An entry larger than the cache was stored")
+	}
+
+	// Entries left by an earlier server count towards the size
+	c, err = newDiskCache(dir, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.size > 15 {
+		t.Errorf("Cache size %d after reopening, want at most 15", c.size)
+	}
+}
+
+func TestServeCachedHeaders(t *testing.T) {
+	run := func() (interface{}, *handlerError) { return "ok", nil }
+	for revalidate, want := range map[bool]string{false: "public, max-age=86400", true: "no-cache"} {
+		w := httptest.NewRecorder()
+		serveCached(w, httptest.NewRequest("GET", "/", nil), "key", revalidate, run)
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control %q, want %q", got, want)
+		}
+
+		if got := w.Header().Get("ETag"); got != `"key"` {
+			t.Errorf("ETag %s, want \"key\"", got)
+		}
+	}
+}
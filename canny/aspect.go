@@ -0,0 +1,119 @@
+package canny
+
+import (
+	"context"
+	"image"
+	"math"
+	"sort"
+)
+
+// bar is a column of calm pixels ending in the current row, starting at x
+type bar struct {
+	x      int
+	height int
+}
+
+// FindAspectRects finds the largest calm rectangles in the given cannied
+// image of which the width / height ratio lies between minAspect and
+// maxAspect, a bound of 0 is not checked. Every maximal calm rectangle is
+// shrunk around its center to the largest one within the bounds. Pixels
+// marked in mask are busy, mask is optional and has the size of the image.
+// It stops with the error of ctx when ctx is done.
+func FindAspectRects(
+	ctx context.Context,
+	cannied *Image,
+	mask *Mask,
+	minWidth,
+	minHeight int,
+	minAspect,
+	maxAspect float64,
+) (Rectangles, error) {
+	width := cannied.Width()
+	height := cannied.Height()
+	if mask != nil && (mask.Width() != width || mask.Height() != height) {
+		return nil, ErrInvalidBounds
+	}
+
+	busy := func(x, y int) bool {
+		return cannied.At(x, y) != 0 || (mask != nil && mask.Busy(x, y))
+	}
+
+	// heights contains the amount of calm pixels above and including the
+	// current row in each column, below[x] the amount of busy pixels left
+	// of column x in the next row
+	heights := make([]int, width)
+	below := make([]int, width+1)
+	stack := make([]bar, 0, width+1)
+	var rects Rectangles
+
+	for y := 0; y < height; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < width; x++ {
+			heights[x]++
+			if busy(x, y) {
+				heights[x] = 0
+			}
+
+			below[x+1] = below[x] + 1
+			if y+1 < height && !busy(x, y+1) {
+				below[x+1] = below[x]
+			}
+		}
+
+		// Every bar that is popped from the stack is the height of a
+		// rectangle that can not grow left, right or up
+		stack = stack[:0]
+		for x := 0; x <= width; x++ {
+			h := 0
+			if x < width {
+				h = heights[x]
+			}
+
+			start := x
+			for len(stack) != 0 && stack[len(stack)-1].height >= h {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				start = top.x
+				if top.height == h {
+					continue
+				}
+
+				// Fitting only shrinks rectangles, and those that can
+				// still grow down are found in a later row
+				if x-top.x < minWidth || top.height < minHeight || below[x] == below[top.x] {
+					continue
+				}
+
+				rect := fitAspect(image.Rect(top.x, y+1-top.height, x, y+1), minAspect, maxAspect)
+				if rect.Dx() >= minWidth && rect.Dy() >= minHeight && !rect.Empty() {
+					rects = append(rects, &rect)
+				}
+			}
+
+			stack = append(stack, bar{start, h})
+		}
+	}
+
+	sort.Sort(rects)
+	return rects, nil
+}
+
+// fitAspect returns the largest rectangle centered in r of which the width
+// / height ratio lies between minAspect and maxAspect
+func fitAspect(r image.Rectangle, minAspect, maxAspect float64) image.Rectangle {
+	w := r.Dx()
+	h := r.Dy()
+	switch {
+	case maxAspect > 0 && float64(w) > float64(h)*maxAspect:
+		w = int(math.Round(float64(h) * maxAspect))
+	case minAspect > 0 && float64(w) < float64(h)*minAspect:
+		h = int(math.Round(float64(w) / minAspect))
+	}
+
+	x := r.Min.X + (r.Dx()-w)/2
+	y := r.Min.Y + (r.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
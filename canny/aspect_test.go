@@ -0,0 +1,115 @@
+package canny
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func TestFitAspect(t *testing.T) {
+	tests := []struct {
+		r         image.Rectangle
+		minAspect float64
+		maxAspect float64
+		want      image.Rectangle
+	}{
+		{image.Rect(0, 0, 100, 50), 0, 0, image.Rect(0, 0, 100, 50)},
+		{image.Rect(0, 0, 100, 50), 1, 3, image.Rect(0, 0, 100, 50)},
+		{image.Rect(0, 0, 100, 50), 1, 1, image.Rect(25, 0, 75, 50)},
+		{image.Rect(0, 0, 100, 50), 0, 1.5, image.Rect(12, 0, 87, 50)},
+		{image.Rect(0, 0, 50, 100), 1, 0, image.Rect(0, 25, 50, 75)},
+		{image.Rect(0, 0, 50, 100), 0.75, 2, image.Rect(0, 16, 50, 83)},
+		{image.Rect(10, 20, 40, 30), 1, 1, image.Rect(20, 20, 30, 30)},
+		{image.Rect(10, 20, 40, 30), 0, 3, image.Rect(10, 20, 40, 30)},
+	}
+
+	for _, test := range tests {
+		got := fitAspect(test.r, test.minAspect, test.maxAspect)
+		if got != test.want {
+			t.Errorf("fitAspect(%v, %v, %v) = %v, want %v", test.r, test.minAspect, test.maxAspect, got, test.want)
+		}
+	}
+}
+
+// calmImage returns a w x h edge map of which only the pixels in busy are
+// set
+func calmImage(w, h int, busy ...image.Rectangle) *Image {
+	pix := make([]uint8, w*h)
+	for _, r := range busy {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				pix[w*y+x] = 255
+			}
+		}
+	}
+
+	return fromPixels(pix, w, h)
+}
+
+func TestFindAspectRects(t *testing.T) {
+	calm := calmImage(100, 60)
+	defer calm.Release()
+
+	split := calmImage(100, 60, image.Rect(40, 0, 42, 60))
+	defer split.Release()
+
+	mask := NewMask(100, 60)
+	mask.Fill(image.Rect(0, 0, 100, 20))
+
+	tests := []struct {
+		name      string
+		img       *Image
+		mask      *Mask
+		minSize   int
+		minAspect float64
+		maxAspect float64
+		want      []image.Rectangle
+	}{
+		{"unbounded", calm, nil, 10, 0, 0, []image.Rectangle{image.Rect(0, 0, 100, 60)}},
+		{"square", calm, nil, 10, 1, 1, []image.Rectangle{image.Rect(20, 0, 80, 60)}},
+		{"wide", calm, nil, 10, 2, 0, []image.Rectangle{image.Rect(0, 5, 100, 55)}},
+		{"masked", calm, mask, 10, 1, 1, []image.Rectangle{image.Rect(30, 20, 70, 60)}},
+		{"too small", calm, mask, 50, 1, 1, nil},
+		{"split", split, nil, 10, 0, 1, []image.Rectangle{
+			image.Rect(42, 0, 100, 60),
+			image.Rect(0, 0, 40, 60),
+		}},
+	}
+
+	for _, test := range tests {
+		rects, err := FindAspectRects(context.Background(), test.img, test.mask, test.minSize, test.minSize, test.minAspect, test.maxAspect)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		rects = FilterOverlap(rects, len(rects))
+		if len(rects) != len(test.want) {
+			t.Errorf("%s: found %v, want %v", test.name, rects, test.want)
+			continue
+		}
+
+		for i, r := range rects {
+			aspect := float64(r.Dx()) / float64(r.Dy())
+			if *r != test.want[i] {
+				t.Errorf("%s: rect %d is %v, want %v", test.name, i, r, test.want[i])
+			}
+
+			if (test.minAspect > 0 && aspect < test.minAspect-0.05) || (test.maxAspect > 0 && aspect > test.maxAspect+0.05) {
+				t.Errorf("%s: rect %v has aspect %.2f", test.name, r, aspect)
+			}
+		}
+	}
+
+	// Only maximal rectangles are candidates
+	rects, err := FindAspectRects(context.Background(), calm, nil, 10, 10, 0, 0)
+	if err != nil || len(rects) != 1 {
+		t.Errorf("Found %d candidates in a calm image, want 1: %v", len(rects), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FindAspectRects(ctx, calm, nil, 10, 10, 1, 1); err != context.Canceled {
+		t.Errorf("Got %v, want the error of the context", err)
+	}
+}
@@ -1,17 +1,17 @@
+// Package canny finds calm rectangles in images using canny edge detection.
+//
+// The default backend is written in pure Go. Build with the opencv tag to
+// use the opencv backend instead.
 package canny
 
 import (
+	"context"
 	"errors"
 	"image"
-	"io"
-	"io/ioutil"
-	"unsafe"
-
-	"github.com/lazywei/go-opencv/opencv"
 )
 
 // ErrLoadFailed will be returned if given imagedata can not be loaded
-// by opencv
+// by the backend
 var ErrLoadFailed = errors.New("Image failed to load")
 
 // ErrInvalidBounds will be returned if the given bounds do not fully overlap
@@ -43,7 +43,7 @@ func maxInt(n, m int) int {
 	return m
 }
 
-func matSum(mat []int, width int) []int {
+func matSum(ctx context.Context, mat []int, width int) ([]int, error) {
 	sum := make([]int, len(mat))
 	height := len(mat) / width
 
@@ -56,6 +56,10 @@ func matSum(mat []int, width int) []int {
 	}
 
 	for y := 1; y < height; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		for x := 1; x < width; x++ {
 			if mat[width*y+x] != 0 {
 				sum[width*y+x] = minInt(
@@ -70,10 +74,10 @@ func matSum(mat []int, width int) []int {
 		}
 	}
 
-	return sum
+	return sum, nil
 }
 
-func matRects(sum []int, width, minWidth, minHeight int) Rectangles {
+func matRects(ctx context.Context, sum []int, width, minWidth, minHeight int) (Rectangles, error) {
 	height := len(sum) / width
 
 	var curr int
@@ -83,6 +87,10 @@ func matRects(sum []int, width, minWidth, minHeight int) Rectangles {
 	var rects Rectangles
 
 	for y := height - 1; y > 0; y-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		for x := width - 1; x > 0; x-- {
 			curr = sum[width*y+x]
 			west = sum[width*y+x-1]
@@ -138,38 +146,14 @@ func matRects(sum []int, width, minWidth, minHeight int) Rectangles {
 
 	}
 
-	return rects
-}
-
-func fromByteSlice(data []byte) *opencv.IplImage {
-	// passing an empty slice to CreateMatHeader will fail HARD.
-	if len(data) == 0 {
-		return nil
-	}
-
-	buf := opencv.CreateMatHeader(1, len(data), opencv.CV_8U)
-	buf.SetData(unsafe.Pointer(&data[0]), opencv.CV_AUTOSTEP)
-	defer buf.Release()
-
-	return opencv.DecodeImage(unsafe.Pointer(buf), opencv.CV_LOAD_IMAGE_GRAYSCALE)
+	return rects, nil
 }
 
-// Load as grayscale en resize
-func Load(reader io.Reader, maxSize int) (*opencv.IplImage, int, int, error) {
-	data, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return nil, 0, 0, err
-	}
-
-	src := fromByteSlice(data)
-	if src == nil {
-		return nil, 0, 0, ErrLoadFailed
-	}
-
-	origWidth := src.Width()
-	origHeight := src.Height()
-	w := origWidth
-	h := origHeight
+// scaledSize returns the dimensions of a width x height image scaled down
+// to fit within maxSize x maxSize
+func scaledSize(width, height, maxSize int) (int, int) {
+	w := width
+	h := height
 	r := float64(w) / float64(h)
 	if w > maxSize {
 		w = maxSize
@@ -181,23 +165,13 @@ func Load(reader io.Reader, maxSize int) (*opencv.IplImage, int, int, error) {
 		h = maxSize
 	}
 
-	if w == origWidth && h == origHeight {
-		return src, origWidth, origHeight, nil
-	}
-	defer src.Release()
-
-	dst := opencv.Resize(src, w, h, 0)
-
-	return dst, origWidth, origHeight, nil
+	return w, h
 }
 
-// CropBounds crops a single image into multiple defined by bounds.
-func CropBounds(img *opencv.IplImage, bounds []*image.Rectangle) ([]*opencv.IplImage, error) {
-	imgs := make([]*opencv.IplImage, len(bounds))
-	w := img.Width()
-	h := img.Height()
-
-	for i, b := range bounds {
+// checkBounds returns ErrInvalidBounds if any of the bounds does not fit
+// within a w x h image.
+func checkBounds(bounds []*image.Rectangle, w, h int) error {
+	for _, b := range bounds {
 		if b.Min.X < 0 ||
 			b.Max.X < 0 ||
 			b.Min.Y < 0 ||
@@ -206,45 +180,38 @@ func CropBounds(img *opencv.IplImage, bounds []*image.Rectangle) ([]*opencv.IplI
 			b.Max.X > w ||
 			b.Min.Y > h ||
 			b.Max.Y > h {
-			return nil, ErrInvalidBounds
+			return ErrInvalidBounds
 		}
-
-		imgs[i] = opencv.Crop(img, b.Min.X, b.Min.Y, b.Dx(), b.Dy())
-	}
-
-	return imgs, nil
-}
-
-// Canny the image
-func Canny(src *opencv.IplImage, threshold, ratio float64, clone bool) *opencv.IplImage {
-	dst := src
-	if clone {
-		dst = src.Clone()
 	}
 
-	if blur := minInt(src.Width(), src.Height()) / 20; blur != 0 {
-		opencv.Smooth(dst, dst, opencv.CV_BLUR, blur, blur, 0, 0)
-	}
-
-	opencv.Canny(dst, dst, threshold, threshold*ratio, 3)
-
-	return dst
+	return nil
 }
 
-// FindRects in the given cannied image
-func FindRects(cannied *opencv.IplImage, minWidth, minHeight int) Rectangles {
+// FindRects in the given cannied image. Pixels marked in mask are busy,
+// mask is optional and has the size of the image. It stops with the error
+// of ctx when ctx is done.
+func FindRects(ctx context.Context, cannied *Image, mask *Mask, minWidth, minHeight int) (Rectangles, error) {
 	width := cannied.Width()
 	height := cannied.Height()
+	if mask != nil && (mask.Width() != width || mask.Height() != height) {
+		return nil, ErrInvalidBounds
+	}
+
 	mat := make([]int, width*height)
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			if cannied.Get1D(width*y + x).Val()[0] == 0 {
+			if cannied.At(x, y) == 0 && (mask == nil || !mask.Busy(x, y)) {
 				mat[width*y+x] = 1
 			}
 		}
 	}
 
-	return matRects(matSum(mat, width), width, minWidth, minHeight)
+	sum, err := matSum(ctx, mat, width)
+	if err != nil {
+		return nil, err
+	}
+
+	return matRects(ctx, sum, width, minWidth, minHeight)
 }
 
 // FilterOverlap removes rectangles that overlap with larger ones.
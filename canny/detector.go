@@ -0,0 +1,215 @@
+package canny
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// Detector creates a map of busy pixels from an image. Pixels that are not
+// 0 in the returned image are busy. Higher thresholds result in fewer busy
+// pixels. The canny, sobel and laplacian detectors give useful results for
+// thresholds between 0 and 100, the range imgrect searches by default. The
+// entropy detector marks no pixels above 20, its 16 intensity levels have
+// at most 4 bits of entropy. Detect returns the error of ctx when ctx is
+// done.
+type Detector interface {
+	Detect(ctx context.Context, img *Image, threshold float64) (*Image, error)
+}
+
+var detectors = map[string]Detector{
+	"canny":     CannyDetector{Ratio: 3},
+	"sobel":     SobelDetector{Ratio: 3},
+	"laplacian": LaplacianDetector{},
+	"entropy":   EntropyDetector{},
+}
+
+// DefaultDetector is used when no detector is given
+var DefaultDetector Detector = detectors["canny"]
+
+// GetDetector returns the detector registered under name
+func GetDetector(name string) (Detector, bool) {
+	d, ok := detectors[name]
+	return d, ok
+}
+
+// DetectorNames returns the names accepted by GetDetector
+func DetectorNames() []string {
+	names := make([]string, 0, len(detectors))
+	for name := range detectors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// windowSize is the size of the blur or the neighbourhood used to detect
+// busy pixels in a w x h image
+func windowSize(w, h int) int {
+	return maxInt(3, minInt(w, h)/20)
+}
+
+// CannyDetector marks canny edges as busy. The high threshold is the
+// threshold times Ratio.
+type CannyDetector struct {
+	Ratio float64
+}
+
+// Detect edges
+func (d CannyDetector) Detect(ctx context.Context, img *Image, threshold float64) (*Image, error) {
+	return Canny(ctx, img, threshold, d.Ratio, true)
+}
+
+// SobelDetector marks pixels of which the blurred gradient magnitude
+// exceeds the threshold times Ratio as busy.
+type SobelDetector struct {
+	Ratio float64
+}
+
+// Detect gradients
+func (d SobelDetector) Detect(ctx context.Context, img *Image, threshold float64) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w := img.Width()
+	h := img.Height()
+	pix := img.pixels()
+	if blur := minInt(w, h) / 20; blur != 0 {
+		boxBlur(pix, w, h, blur)
+	}
+
+	_, _, mag := sobel(pix, w, h)
+	for i := range mag {
+		pix[i] = 0
+		if float64(mag[i]) > threshold*d.Ratio {
+			pix[i] = 255
+		}
+	}
+
+	return fromPixels(pix, w, h), nil
+}
+
+// LaplacianDetector marks pixels as busy when the standard deviation of the
+// laplacian in their neighbourhood exceeds the threshold.
+type LaplacianDetector struct{}
+
+// Detect local laplacian variance
+func (d LaplacianDetector) Detect(ctx context.Context, img *Image, threshold float64) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w := img.Width()
+	h := img.Height()
+	pix := img.pixels()
+	at := func(x, y int) int {
+		return int(pix[w*clamp(y, 0, h-1)+clamp(x, 0, w-1)])
+	}
+
+	lap := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lap[w*y+x] = float64(at(x-1, y) + at(x+1, y) + at(x, y-1) + at(x, y+1) - 4*at(x, y))
+		}
+	}
+
+	sq := make([]float64, w*h)
+	for i := range lap {
+		sq[i] = lap[i] * lap[i]
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	size := windowSize(w, h)
+	mean := windowMean(lap, w, h, size)
+	meanSq := windowMean(sq, w, h, size)
+	for i := range pix {
+		pix[i] = 0
+		if meanSq[i]-mean[i]*mean[i] > threshold*threshold {
+			pix[i] = 255
+		}
+	}
+
+	return fromPixels(pix, w, h), nil
+}
+
+// EntropyDetector marks pixels as busy when the entropy of the intensities
+// in their neighbourhood exceeds the threshold in fifths of a bit.
+type EntropyDetector struct{}
+
+// entropyBins is the amount of intensity levels used to calculate entropy
+const entropyBins = 16
+
+// Detect local entropy
+func (d EntropyDetector) Detect(ctx context.Context, img *Image, threshold float64) (*Image, error) {
+	w := img.Width()
+	h := img.Height()
+	pix := img.pixels()
+	size := windowSize(w, h)
+
+	entropy := make([]float64, w*h)
+	indicator := make([]float64, w*h)
+	for bin := 0; bin < entropyBins; bin++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for i := range pix {
+			indicator[i] = 0
+			if int(pix[i])*entropyBins/256 == bin {
+				indicator[i] = 1
+			}
+		}
+
+		for i, p := range windowMean(indicator, w, h, size) {
+			if p > 0 {
+				entropy[i] -= p * math.Log2(p)
+			}
+		}
+	}
+
+	for i := range pix {
+		pix[i] = 0
+		if entropy[i] > threshold/5 {
+			pix[i] = 255
+		}
+	}
+
+	return fromPixels(pix, w, h), nil
+}
+
+// windowMean returns the mean of the size x size window around every value
+// of the w x h matrix in values. The window is clipped at the borders.
+func windowMean(values []float64, w, h, size int) []float64 {
+	sum := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum[(w+1)*(y+1)+x+1] = values[w*y+x] +
+				sum[(w+1)*y+x+1] +
+				sum[(w+1)*(y+1)+x] -
+				sum[(w+1)*y+x]
+		}
+	}
+
+	anchor := size / 2
+	mean := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0 := maxInt(0, y-anchor)
+		y1 := minInt(h, y-anchor+size)
+		for x := 0; x < w; x++ {
+			x0 := maxInt(0, x-anchor)
+			x1 := minInt(w, x-anchor+size)
+			area := float64((x1 - x0) * (y1 - y0))
+			mean[w*y+x] = (sum[(w+1)*y1+x1] -
+				sum[(w+1)*y0+x1] -
+				sum[(w+1)*y1+x0] +
+				sum[(w+1)*y0+x0]) / area
+		}
+	}
+
+	return mean
+}
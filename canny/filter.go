@@ -0,0 +1,75 @@
+package canny
+
+func clamp(n, lo, hi int) int {
+	return maxInt(lo, minInt(n, hi))
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+// boxBlur replaces every pixel of the w x h image in pix with the average
+// of the size x size pixels around it. Borders are replicated.
+func boxBlur(pix []uint8, w, h, size int) {
+	tmp := make([]int, w*h)
+	anchor := size / 2
+
+	for y := 0; y < h; y++ {
+		row := pix[w*y:]
+		sum := 0
+		for k := -anchor; k < size-anchor; k++ {
+			sum += int(row[clamp(k, 0, w-1)])
+		}
+
+		for x := 0; x < w; x++ {
+			tmp[w*y+x] = sum
+			sum += int(row[clamp(x+size-anchor, 0, w-1)])
+			sum -= int(row[clamp(x-anchor, 0, w-1)])
+		}
+	}
+
+	area := size * size
+	for x := 0; x < w; x++ {
+		sum := 0
+		for k := -anchor; k < size-anchor; k++ {
+			sum += tmp[w*clamp(k, 0, h-1)+x]
+		}
+
+		for y := 0; y < h; y++ {
+			pix[w*y+x] = uint8((sum + area/2) / area)
+			sum += tmp[w*clamp(y+size-anchor, 0, h-1)+x]
+			sum -= tmp[w*clamp(y-anchor, 0, h-1)+x]
+		}
+	}
+}
+
+// sobel returns the horizontal and vertical 3x3 sobel derivatives of the
+// w x h image in pix and their L1 magnitude. Borders are replicated.
+func sobel(pix []uint8, w, h int) (dx, dy, mag []int) {
+	at := func(x, y int) int {
+		return int(pix[w*clamp(y, 0, h-1)+clamp(x, 0, w-1)])
+	}
+
+	dx = make([]int, w*h)
+	dy = make([]int, w*h)
+	mag = make([]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+
+			i := w*y + x
+			dx[i] = gx
+			dy[i] = gy
+			mag[i] = absInt(gx) + absInt(gy)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,172 @@
+package canny
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The golden files are recorded with the pure Go backend. CI also runs the
+// tests with -tags opencv, which compares the rectangles of the opencv
+// backend to them. The backends blur and trace edges differently, so they
+// agree when every golden rectangle has a found rectangle of which the
+// intersection over union is at least goldenOverlap, in any order.
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+const (
+	goldenThreshold = 9
+	goldenMinSize   = 20
+	goldenAmount    = 5
+	// goldenOverlap is the intersection over union a golden rectangle and
+	// the rectangle found for it need to be comparable
+	goldenOverlap = 0.5
+)
+
+// findGolden finds the rectangles of the fixture at path, the golden
+// files contain them as [x1, y1, x2, y2]
+func findGolden(t *testing.T, path string) Rectangles {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, _, _, err := Load(f, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Release()
+
+	ctx := context.Background()
+	cannied, err := CannyDetector{Ratio: 3}.Detect(ctx, img, goldenThreshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cannied.Release()
+
+	rects, err := FindRects(ctx, cannied, nil, goldenMinSize, goldenMinSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(rects)
+	return FilterOverlap(rects, goldenAmount)
+}
+
+// overlap returns the intersection over union of a and b
+func overlap(a, b image.Rectangle) float64 {
+	i := a.Intersect(b)
+	inter := i.Dx() * i.Dy()
+	union := a.Dx()*a.Dy() + b.Dx()*b.Dy() - inter
+	if union == 0 {
+		return 0
+	}
+
+	return float64(inter) / float64(union)
+}
+
+func TestGolden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fixtures) == 0 {
+		t.Fatal("No fixtures in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		golden := strings.TrimSuffix(fixture, ".png") + ".golden.json"
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			rects := findGolden(t, fixture)
+			if *update {
+				values := make([][4]int, len(rects))
+				for i, r := range rects {
+					values[i] = [4]int{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y}
+				}
+
+				data, err := json.Marshal(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := ioutil.WriteFile(golden, append(data, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			data, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var values [][4]int
+			if err := json.Unmarshal(data, &values); err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]image.Rectangle, len(values))
+			for i, v := range values {
+				want[i] = image.Rect(v[0], v[1], v[2], v[3])
+			}
+
+			for _, w := range want {
+				best := 0.0
+				for _, r := range rects {
+					if o := overlap(w, *r); o > best {
+						best = o
+					}
+				}
+
+				if best < goldenOverlap {
+					t.Errorf("No rectangle comparable to %v, best overlap %.2f", w, best)
+				}
+			}
+		})
+	}
+}
+
+func TestFromImage(t *testing.T) {
+	f, err := os.Open("testdata/gradient.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	src, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, w, h, err := FromImage(src, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Release()
+
+	if w != 240 || h != 180 {
+		t.Errorf("Original size %dx%d, want 240x180", w, h)
+	}
+
+	if img.Width() != 120 || img.Height() != 90 {
+		t.Errorf("Scaled size %dx%d, want 120x90", img.Width(), img.Height())
+	}
+
+	if img.Color() == nil {
+		t.Error("Colors were not kept")
+	}
+
+	if _, _, _, err := FromImage(image.NewGray(image.Rect(0, 0, 0, 0)), 120); err != ErrLoadFailed {
+		t.Errorf("Empty image returned %v, want ErrLoadFailed", err)
+	}
+}
@@ -0,0 +1,591 @@
+package canny
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cascadeScaleFactor is the factor the window of a cascade grows by
+	// between scales
+	cascadeScaleFactor = 1.1
+	// cascadeMinNeighbors is the amount of overlapping detections an
+	// object needs to be returned
+	cascadeMinNeighbors = 3
+	// cascadeGroupEps is the relative distance within which detections
+	// are grouped
+	cascadeGroupEps = 0.2
+)
+
+// ErrInvalidCascade is returned by ParseCascade when the cascade is not a
+// haar cascade that can be evaluated
+var ErrInvalidCascade = errors.New("Invalid haar cascade")
+
+// haarRect is a weighted rectangle of a feature
+type haarRect struct {
+	x, y, w, h int
+	weight     float64
+}
+
+// haarNode compares the value of its feature to its threshold. Left and
+// right are the indexes of the next node or, when not positive, minus the
+// index of the value of the leaf.
+type haarNode struct {
+	rects     []haarRect
+	threshold float64
+	left      int
+	right     int
+}
+
+type haarTree struct {
+	nodes  []haarNode
+	leaves []float64
+}
+
+type haarStage struct {
+	trees     []haarTree
+	threshold float64
+}
+
+// Cascade is a haar cascade of boosted classifiers that detects objects of
+// one kind, like faces. Like opencv it only accepts windows that pass every
+// stage.
+type Cascade struct {
+	width  int
+	height int
+	stages []haarStage
+}
+
+// xmlCascade contains the cascades of opencv in both the old format of
+// haarcascade_*.xml files and the newer format of opencv_traincascade
+type xmlCascade struct {
+	TypeID string `xml:"type_id,attr"`
+
+	// Old format
+	Size string `xml:"size"`
+
+	// New format
+	StageType   string    `xml:"stageType"`
+	FeatureType string    `xml:"featureType"`
+	Width       int       `xml:"width"`
+	Height      int       `xml:"height"`
+	Features    []xmlFeat `xml:"features>_"`
+
+	Stages []xmlStage `xml:"stages>_"`
+}
+
+type xmlStage struct {
+	// Old format
+	Trees          []xmlTree `xml:"trees>_"`
+	StageThreshold float64   `xml:"stage_threshold"`
+
+	// New format
+	WeakClassifiers []xmlWeak `xml:"weakClassifiers>_"`
+	Threshold       float64   `xml:"stageThreshold"`
+}
+
+type xmlTree struct {
+	Nodes []xmlNode `xml:"_"`
+}
+
+type xmlNode struct {
+	Feature   xmlFeat  `xml:"feature"`
+	Threshold float64  `xml:"threshold"`
+	LeftVal   *float64 `xml:"left_val"`
+	RightVal  *float64 `xml:"right_val"`
+	LeftNode  *int     `xml:"left_node"`
+	RightNode *int     `xml:"right_node"`
+}
+
+type xmlFeat struct {
+	Rects  []string `xml:"rects>_"`
+	Tilted int      `xml:"tilted"`
+}
+
+type xmlWeak struct {
+	InternalNodes string `xml:"internalNodes"`
+	LeafValues    string `xml:"leafValues"`
+}
+
+// parseFloats parses the space separated numbers in s
+func parseFloats(s string) ([]float64, error) {
+	fields := strings.Fields(s)
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, ErrInvalidCascade
+		}
+
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+// rects parses the rectangles of the feature
+func (f *xmlFeat) rects() ([]haarRect, error) {
+	if f.Tilted != 0 || len(f.Rects) == 0 || len(f.Rects) > 3 {
+		return nil, ErrInvalidCascade
+	}
+
+	rects := make([]haarRect, len(f.Rects))
+	for i, raw := range f.Rects {
+		v, err := parseFloats(raw)
+		if err != nil || len(v) != 5 {
+			return nil, ErrInvalidCascade
+		}
+
+		rects[i] = haarRect{int(v[0]), int(v[1]), int(v[2]), int(v[3]), v[4]}
+	}
+
+	return rects, nil
+}
+
+// ParseCascade reads a haar cascade in one of the XML formats of opencv,
+// like the haarcascade_frontalface_alt.xml file it ships with. Cascades
+// with tilted features are not supported.
+func ParseCascade(r io.Reader) (*Cascade, error) {
+	var doc struct {
+		Cascade xmlCascade `xml:",any"`
+	}
+
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, ErrInvalidCascade
+	}
+
+	var c *Cascade
+	var err error
+	switch {
+	case doc.Cascade.TypeID == "opencv-haar-classifier":
+		c, err = parseOldCascade(&doc.Cascade)
+	case doc.Cascade.TypeID == "opencv-cascade-classifier" || doc.Cascade.StageType != "":
+		// opencv_traincascade leaves out the type
+		c, err = parseNewCascade(&doc.Cascade)
+	default:
+		return nil, ErrInvalidCascade
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.width < 3 || c.height < 3 || len(c.stages) == 0 {
+		return nil, ErrInvalidCascade
+	}
+
+	return c, nil
+}
+
+func parseOldCascade(x *xmlCascade) (*Cascade, error) {
+	c := &Cascade{}
+	size := strings.Fields(x.Size)
+	if len(size) != 2 {
+		return nil, ErrInvalidCascade
+	}
+
+	c.width, _ = strconv.Atoi(size[0])
+	c.height, _ = strconv.Atoi(size[1])
+	for _, s := range x.Stages {
+		stage := haarStage{threshold: s.StageThreshold}
+		for _, t := range s.Trees {
+			var tree haarTree
+			for _, n := range t.Nodes {
+				rects, err := n.Feature.rects()
+				if err != nil {
+					return nil, err
+				}
+
+				node := haarNode{rects: rects, threshold: n.Threshold}
+				switch {
+				case n.LeftNode != nil && *n.LeftNode > 0:
+					node.left = *n.LeftNode
+				case n.LeftVal != nil:
+					node.left = -len(tree.leaves)
+					tree.leaves = append(tree.leaves, *n.LeftVal)
+				default:
+					return nil, ErrInvalidCascade
+				}
+
+				switch {
+				case n.RightNode != nil && *n.RightNode > 0:
+					node.right = *n.RightNode
+				case n.RightVal != nil:
+					node.right = -len(tree.leaves)
+					tree.leaves = append(tree.leaves, *n.RightVal)
+				default:
+					return nil, ErrInvalidCascade
+				}
+
+				tree.nodes = append(tree.nodes, node)
+			}
+
+			if err := tree.check(); err != nil {
+				return nil, err
+			}
+
+			stage.trees = append(stage.trees, tree)
+		}
+
+		c.stages = append(c.stages, stage)
+	}
+
+	return c, nil
+}
+
+func parseNewCascade(x *xmlCascade) (*Cascade, error) {
+	if x.StageType != "BOOST" || x.FeatureType != "HAAR" {
+		return nil, ErrInvalidCascade
+	}
+
+	features := make([][]haarRect, len(x.Features))
+	for i := range x.Features {
+		rects, err := x.Features[i].rects()
+		if err != nil {
+			return nil, err
+		}
+
+		features[i] = rects
+	}
+
+	c := &Cascade{width: x.Width, height: x.Height}
+	for _, s := range x.Stages {
+		stage := haarStage{threshold: s.Threshold}
+		for _, w := range s.WeakClassifiers {
+			nodes, err := parseFloats(w.InternalNodes)
+			if err != nil || len(nodes) == 0 || len(nodes)%4 != 0 {
+				return nil, ErrInvalidCascade
+			}
+
+			leaves, err := parseFloats(w.LeafValues)
+			if err != nil {
+				return nil, err
+			}
+
+			tree := haarTree{leaves: leaves}
+			for i := 0; i < len(nodes); i += 4 {
+				feature := int(nodes[i+2])
+				if feature < 0 || feature >= len(features) {
+					return nil, ErrInvalidCascade
+				}
+
+				tree.nodes = append(tree.nodes, haarNode{
+					rects:     features[feature],
+					threshold: nodes[i+3],
+					left:      int(nodes[i]),
+					right:     int(nodes[i+1]),
+				})
+			}
+
+			if err := tree.check(); err != nil {
+				return nil, err
+			}
+
+			stage.trees = append(stage.trees, tree)
+		}
+
+		c.stages = append(c.stages, stage)
+	}
+
+	return c, nil
+}
+
+// check that the nodes of the tree only refer to nodes further down and
+// to existing leaves, so evaluating it ends
+func (t *haarTree) check() error {
+	if len(t.nodes) == 0 {
+		return ErrInvalidCascade
+	}
+
+	for i, n := range t.nodes {
+		for _, next := range []int{n.left, n.right} {
+			if (next > 0 && (next <= i || next >= len(t.nodes))) || (next <= 0 && -next >= len(t.leaves)) {
+				return ErrInvalidCascade
+			}
+		}
+	}
+
+	return nil
+}
+
+// integral images of the pixels and their squares, one row and column
+// larger than the image
+type integral struct {
+	width int
+	sum   []int64
+	sqsum []int64
+}
+
+func newIntegral(pix []uint8, w, h int) *integral {
+	ii := &integral{w + 1, make([]int64, (w+1)*(h+1)), make([]int64, (w+1)*(h+1))}
+	for y := 0; y < h; y++ {
+		var row, sqrow int64
+		for x := 0; x < w; x++ {
+			p := int64(pix[w*y+x])
+			row += p
+			sqrow += p * p
+			i := ii.width*(y+1) + x + 1
+			ii.sum[i] = ii.sum[i-ii.width] + row
+			ii.sqsum[i] = ii.sqsum[i-ii.width] + sqrow
+		}
+	}
+
+	return ii
+}
+
+// rectSum returns the sum of values within x, y, w, h
+func (ii *integral) rectSum(values []int64, x, y, w, h int) int64 {
+	a := ii.width*y + x
+	b := ii.width*(y+h) + x
+	return values[b+w] - values[b] - values[a+w] + values[a]
+}
+
+// scaledCascade is a cascade of which the features are scaled to a window
+// and weighted by its area, like cvSetImagesForHaarClassifierCascade does
+type scaledCascade struct {
+	*Cascade
+	// nodes contains the scaled rectangles of every node, by stage, tree
+	// and node
+	nodes [][][][]haarRect
+	// window is the scaled window without its border, which is used to
+	// normalize the variance
+	window  image.Rectangle
+	invArea float64
+	width   int
+	height  int
+}
+
+func (c *Cascade) scale(factor float64) *scaledCascade {
+	round := func(v int) int { return int(math.Round(float64(v) * factor)) }
+	s := &scaledCascade{
+		Cascade: c,
+		window:  image.Rect(round(1), round(1), round(1)+round(c.width-2), round(1)+round(c.height-2)),
+		width:   round(c.width),
+		height:  round(c.height),
+	}
+
+	s.invArea = 1 / float64(s.window.Dx()*s.window.Dy())
+	s.nodes = make([][][][]haarRect, len(c.stages))
+	for i, stage := range c.stages {
+		s.nodes[i] = make([][][]haarRect, len(stage.trees))
+		for j, tree := range stage.trees {
+			s.nodes[i][j] = make([][]haarRect, len(tree.nodes))
+			for k, node := range tree.nodes {
+				rects := make([]haarRect, len(node.rects))
+				area0 := 0
+				sum0 := 0.0
+				for l, r := range node.rects {
+					rects[l] = haarRect{round(r.x), round(r.y), round(r.w), round(r.h), r.weight * s.invArea}
+					if l == 0 {
+						area0 = rects[l].w * rects[l].h
+						continue
+					}
+
+					sum0 += rects[l].weight * float64(rects[l].w*rects[l].h)
+				}
+
+				// The weights have to cancel out after rounding
+				if area0 != 0 {
+					rects[0].weight = -sum0 / float64(area0)
+				}
+
+				s.nodes[i][j][k] = rects
+			}
+		}
+	}
+
+	return s
+}
+
+// accepts reports whether the window at x, y passes every stage
+func (s *scaledCascade) accepts(ii *integral, x, y int) bool {
+	wx := x + s.window.Min.X
+	wy := y + s.window.Min.Y
+	ww := s.window.Dx()
+	wh := s.window.Dy()
+	mean := float64(ii.rectSum(ii.sum, wx, wy, ww, wh)) * s.invArea
+	variance := float64(ii.rectSum(ii.sqsum, wx, wy, ww, wh))*s.invArea - mean*mean
+	// Calm windows are not normalized, like in opencv_traincascade
+	norm := 1.0
+	if variance > 0 {
+		norm = math.Sqrt(variance)
+	}
+
+	for i, stage := range s.stages {
+		sum := 0.0
+		for j, tree := range stage.trees {
+			idx := 0
+			for {
+				node := &tree.nodes[idx]
+				value := 0.0
+				for _, r := range s.nodes[i][j][idx] {
+					value += float64(ii.rectSum(ii.sum, x+r.x, y+r.y, r.w, r.h)) * r.weight
+				}
+
+				next := node.right
+				if value < node.threshold*norm {
+					next = node.left
+				}
+
+				if next <= 0 {
+					sum += tree.leaves[-next]
+					break
+				}
+
+				idx = next
+			}
+		}
+
+		if sum < stage.threshold {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Detect returns the objects in img. The window of the cascade is grown
+// until it no longer fits in the image, overlapping detections are grouped
+// and only groups of several detections are returned. It stops with the
+// error of ctx when ctx is done.
+func (c *Cascade) Detect(ctx context.Context, img *Image) (Rectangles, error) {
+	w := img.Width()
+	h := img.Height()
+	ii := newIntegral(img.pixels(), w, h)
+
+	var found []image.Rectangle
+	for factor := 1.0; float64(c.width)*factor < float64(w-10) && float64(c.height)*factor < float64(h-10); factor *= cascadeScaleFactor {
+		s := c.scale(factor)
+		step := math.Max(2, factor)
+		for iy := 0; ; iy++ {
+			y := int(math.Round(float64(iy) * step))
+			if y+s.height > h {
+				break
+			}
+
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			for ix := 0; ; ix++ {
+				x := int(math.Round(float64(ix) * step))
+				if x+s.width > w {
+					break
+				}
+
+				if s.accepts(ii, x, y) {
+					found = append(found, image.Rect(x, y, x+s.width, y+s.height))
+				}
+			}
+		}
+	}
+
+	return groupRects(found, cascadeMinNeighbors, cascadeGroupEps), nil
+}
+
+// similarRects reports whether a and b are within eps of each other,
+// relative to their size
+func similarRects(a, b image.Rectangle, eps float64) bool {
+	delta := eps * float64(minInt(a.Dx(), b.Dx())+minInt(a.Dy(), b.Dy())) / 2
+	return math.Abs(float64(a.Min.X-b.Min.X)) <= delta &&
+		math.Abs(float64(a.Min.Y-b.Min.Y)) <= delta &&
+		math.Abs(float64(a.Max.X-b.Max.X)) <= delta &&
+		math.Abs(float64(a.Max.Y-b.Max.Y)) <= delta
+}
+
+// groupRects averages the groups of similar rectangles, like the
+// groupRectangles function of opencv. Groups of at most minNeighbors
+// rectangles and groups within larger groups are dropped.
+func groupRects(rects []image.Rectangle, minNeighbors int, eps float64) Rectangles {
+	labels := make([]int, len(rects))
+	for i := range labels {
+		labels[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if labels[i] != i {
+			labels[i] = find(labels[i])
+		}
+
+		return labels[i]
+	}
+
+	for i := range rects {
+		for j := 0; j < i; j++ {
+			if similarRects(rects[i], rects[j], eps) {
+				labels[find(i)] = find(j)
+			}
+		}
+	}
+
+	type group struct {
+		sum   [4]int
+		count int
+	}
+
+	var groups []*group
+	byRoot := map[int]*group{}
+	for i, r := range rects {
+		root := find(i)
+		g, ok := byRoot[root]
+		if !ok {
+			g = &group{}
+			byRoot[root] = g
+			groups = append(groups, g)
+		}
+
+		g.sum[0] += r.Min.X
+		g.sum[1] += r.Min.Y
+		g.sum[2] += r.Dx()
+		g.sum[3] += r.Dy()
+		g.count++
+	}
+
+	avg := make([]image.Rectangle, len(groups))
+	for i, g := range groups {
+		x := g.sum[0] / g.count
+		y := g.sum[1] / g.count
+		avg[i] = image.Rect(x, y, x+g.sum[2]/g.count, y+g.sum[3]/g.count)
+	}
+
+	var grouped Rectangles
+	for i, r1 := range avg {
+		n1 := groups[i].count
+		if n1 <= minNeighbors {
+			continue
+		}
+
+		inside := false
+		for j, r2 := range avg {
+			n2 := groups[j].count
+			if i == j || n2 <= minNeighbors {
+				continue
+			}
+
+			dx := int(float64(r2.Dx()) * eps)
+			dy := int(float64(r2.Dy()) * eps)
+			if r1.Min.X >= r2.Min.X-dx &&
+				r1.Min.Y >= r2.Min.Y-dy &&
+				r1.Max.X <= r2.Max.X+dx &&
+				r1.Max.Y <= r2.Max.Y+dy &&
+				(n2 > maxInt(3, n1) || n1 < 3) {
+				inside = true
+				break
+			}
+		}
+
+		if !inside {
+			r := r1
+			grouped = append(grouped, &r)
+		}
+	}
+
+	return grouped
+}
@@ -0,0 +1,151 @@
+package canny
+
+import (
+	"context"
+	"image"
+	"strings"
+	"testing"
+)
+
+// The test cascades accept windows of which the center is much darker than
+// the rest, in the old and the new format of opencv
+const (
+	oldCascade = `<?xml version="1.0"?>
+<opencv_storage>
+<test_cascade type_id="opencv-haar-classifier">
+  <size>24 24</size>
+  <stages>
+    <_>
+      <!-- tree 0 -->
+      <trees>
+        <_>
+          <_>
+            <feature>
+              <rects>
+                <_>0 0 24 24 -1.</_>
+                <_>6 6 12 12 4.</_></rects>
+              <tilted>0</tilted></feature>
+            <threshold>-1.</threshold>
+            <left_val>1.</left_val>
+            <right_val>-1.</right_val></_></_></trees>
+      <stage_threshold>0.</stage_threshold>
+      <parent>-1</parent>
+      <next>-1</next></_></stages></test_cascade>
+</opencv_storage>`
+
+	newCascade = `<?xml version="1.0"?>
+<opencv_storage>
+<cascade>
+  <stageType>BOOST</stageType>
+  <featureType>HAAR</featureType>
+  <height>24</height>
+  <width>24</width>
+  <stageNum>1</stageNum>
+  <stages>
+    <_>
+      <maxWeakCount>1</maxWeakCount>
+      <stageThreshold>0.</stageThreshold>
+      <weakClassifiers>
+        <_>
+          <internalNodes>0 -1 0 -1.</internalNodes>
+          <leafValues>1. -1.</leafValues></_></weakClassifiers></_></stages>
+  <features>
+    <_>
+      <rects>
+        <_>0 0 24 24 -1.</_>
+        <_>6 6 12 12 4.</_></rects></_></features></cascade>
+</opencv_storage>`
+)
+
+// squareImage returns a light w x w image with a dark square at r
+func squareImage(w int, r image.Rectangle) *Image {
+	pix := make([]uint8, w*w)
+	for i := range pix {
+		if image.Pt(i%w, i/w).In(r) {
+			continue
+		}
+
+		pix[i] = 200
+	}
+
+	return fromPixels(pix, w, w)
+}
+
+func TestParseCascade(t *testing.T) {
+	for name, raw := range map[string]string{"old": oldCascade, "new": newCascade} {
+		c, err := ParseCascade(strings.NewReader(raw))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if c.width != 24 || c.height != 24 || len(c.stages) != 1 || len(c.stages[0].trees) != 1 {
+			t.Errorf("%s: got a %dx%d cascade of %d stages", name, c.width, c.height, len(c.stages))
+			continue
+		}
+
+		tree := c.stages[0].trees[0]
+		if len(tree.nodes) != 1 || len(tree.leaves) != 2 || tree.nodes[0].left != 0 || tree.nodes[0].right != -1 {
+			t.Errorf("%s: got tree %+v", name, tree)
+		}
+	}
+
+	invalid := map[string]string{
+		"not xml":     "cascade",
+		"no type":     "<opencv_storage><cascade><size>24 24</size></cascade></opencv_storage>",
+		"tilted":      strings.Replace(oldCascade, "<tilted>0</tilted>", "<tilted>1</tilted>", 1),
+		"no leaf":     strings.Replace(oldCascade, "<right_val>-1.</right_val>", "", 1),
+		"no feature":  strings.Replace(newCascade, "0 -1 0 -1.", "0 -1 1 -1.", 1),
+		"lbp":         strings.Replace(newCascade, "HAAR", "LBP", 1),
+		"bad leaf":    strings.Replace(newCascade, "0 -1 0 -1.", "0 -2 0 -1.", 1),
+		"cyclic tree": strings.Replace(oldCascade, "<right_val>-1.</right_val>", "<right_node>0</right_node>", 1),
+	}
+
+	for name, raw := range invalid {
+		if _, err := ParseCascade(strings.NewReader(raw)); err != ErrInvalidCascade {
+			t.Errorf("%s: got %v, want ErrInvalidCascade", name, err)
+		}
+	}
+}
+
+func TestCascadeDetect(t *testing.T) {
+	c, err := ParseCascade(strings.NewReader(oldCascade))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := squareImage(80, image.Rect(30, 30, 42, 42))
+	defer img.Release()
+
+	found, err := c.Detect(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 {
+		t.Fatalf("Found %v, want 1 object", found)
+	}
+
+	center := found[0].Min.Add(found[0].Max).Div(2)
+	if d := center.Sub(image.Pt(36, 36)); d.X < -3 || d.X > 3 || d.Y < -3 || d.Y > 3 {
+		t.Errorf("Found %v, want it centered on the square", found[0])
+	}
+
+	calm := squareImage(80, image.Rectangle{})
+	defer calm.Release()
+
+	found, err = c.Detect(context.Background(), calm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 0 {
+		t.Errorf("Found %v in a calm image", found)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Detect(ctx, img); err != context.Canceled {
+		t.Errorf("Got %v, want the error of the context", err)
+	}
+}
@@ -0,0 +1,75 @@
+package canny
+
+import "image"
+
+// Mask marks pixels of an image as busy regardless of their edges.
+// FindRects never returns rectangles that contain busy pixels.
+type Mask struct {
+	width  int
+	height int
+	busy   []bool
+}
+
+// NewMask returns a width x height mask without busy pixels
+func NewMask(width, height int) *Mask {
+	return &Mask{width, height, make([]bool, width*height)}
+}
+
+// Width of the mask
+func (m *Mask) Width() int { return m.width }
+
+// Height of the mask
+func (m *Mask) Height() int { return m.height }
+
+// Busy reports whether the pixel at x, y is busy
+func (m *Mask) Busy(x, y int) bool {
+	return m.busy[m.width*y+x]
+}
+
+// Clear reports whether none of the pixels within r are busy, r is clipped
+// to the mask
+func (m *Mask) Clear(r image.Rectangle) bool {
+	r = r.Intersect(image.Rect(0, 0, m.width, m.height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if m.busy[m.width*y+x] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Set marks the pixel at x, y as busy
+func (m *Mask) Set(x, y int) {
+	m.busy[m.width*y+x] = true
+}
+
+// Fill marks the pixels within r as busy, r is clipped to the mask
+func (m *Mask) Fill(r image.Rectangle) {
+	r = r.Intersect(image.Rect(0, 0, m.width, m.height))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			m.busy[m.width*y+x] = true
+		}
+	}
+}
+
+// Crop returns the part of the mask within bounds, like CropBounds does
+// for images
+func (m *Mask) Crop(bounds *image.Rectangle) (*Mask, error) {
+	if err := checkBounds([]*image.Rectangle{bounds}, m.width, m.height); err != nil {
+		return nil, err
+	}
+
+	cropped := NewMask(bounds.Dx(), bounds.Dy())
+	for y := 0; y < cropped.height; y++ {
+		copy(
+			cropped.busy[cropped.width*y:cropped.width*(y+1)],
+			m.busy[m.width*(bounds.Min.Y+y)+bounds.Min.X:],
+		)
+	}
+
+	return cropped, nil
+}
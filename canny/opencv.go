@@ -0,0 +1,176 @@
+//go:build opencv
+// +build opencv
+
+package canny
+
+import (
+	"context"
+	"image"
+	"io"
+	"io/ioutil"
+	"unsafe"
+
+	"github.com/lazywei/go-opencv/opencv"
+)
+
+// Backend is the name of the backend the package is built with
+const Backend = "opencv"
+
+// Image is a grayscale image backed by opencv. Images returned by Load
+// also keep their colors.
+type Image struct {
+	ipl   *opencv.IplImage
+	color *opencv.IplImage
+}
+
+func fromPixels(pix []uint8, w, h int) *Image {
+	ipl := opencv.CreateImage(w, h, opencv.IPL_DEPTH_8U, 1)
+	for i, p := range pix {
+		ipl.Set1D(i, opencv.NewScalar(float64(p), 0, 0, 0))
+	}
+
+	return &Image{ipl: ipl}
+}
+
+// pixels returns a copy of the intensities of all pixels, row by row
+func (img *Image) pixels() []uint8 {
+	pix := make([]uint8, img.Width()*img.Height())
+	for i := range pix {
+		pix[i] = uint8(img.ipl.Get1D(i).Val()[0])
+	}
+
+	return pix
+}
+
+// Width of the image
+func (img *Image) Width() int { return img.ipl.Width() }
+
+// Height of the image
+func (img *Image) Height() int { return img.ipl.Height() }
+
+// At returns the intensity of the pixel at x, y
+func (img *Image) At(x, y int) uint8 {
+	return uint8(img.ipl.Get1D(img.ipl.Width()*y + x).Val()[0])
+}
+
+// Mean intensity of all pixels
+func (img *Image) Mean() float64 { return img.ipl.Avg(nil).Val()[0] }
+
+// Color returns the colors of an image returned by Load, nil otherwise
+func (img *Image) Color() image.Image {
+	if img.color == nil {
+		return nil
+	}
+
+	return img.color.ToImage()
+}
+
+// Release the memory held by opencv
+func (img *Image) Release() {
+	img.ipl.Release()
+	if img.color != nil {
+		img.color.Release()
+	}
+}
+
+func fromByteSlice(data []byte) *opencv.IplImage {
+	// passing an empty slice to CreateMatHeader will fail HARD.
+	if len(data) == 0 {
+		return nil
+	}
+
+	buf := opencv.CreateMatHeader(1, len(data), opencv.CV_8U)
+	buf.SetData(unsafe.Pointer(&data[0]), opencv.CV_AUTOSTEP)
+	defer buf.Release()
+
+	return opencv.DecodeImage(unsafe.Pointer(buf), opencv.CV_LOAD_IMAGE_COLOR)
+}
+
+// Load as grayscale en resize, the colors are kept as well
+func Load(reader io.Reader, maxSize int) (*Image, int, int, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	src := fromByteSlice(data)
+	if src == nil {
+		return nil, 0, 0, ErrLoadFailed
+	}
+
+	return fromIpl(src, maxSize)
+}
+
+// FromImage converts a decoded image to grayscale and resizes it like Load,
+// the colors are kept as well
+func FromImage(src image.Image, maxSize int) (*Image, int, int, error) {
+	b := src.Bounds()
+	if b.Empty() {
+		return nil, 0, 0, ErrLoadFailed
+	}
+
+	ipl := opencv.CreateImage(b.Dx(), b.Dy(), opencv.IPL_DEPTH_8U, 3)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := src.At(x, y).RGBA()
+			ipl.Set1D(i, opencv.NewScalar(float64(bl>>8), float64(g>>8), float64(r>>8), 0))
+			i++
+		}
+	}
+
+	return fromIpl(ipl, maxSize)
+}
+
+// fromIpl resizes the BGR image src and converts it to grayscale, src is
+// released or kept as the colors of the image
+func fromIpl(src *opencv.IplImage, maxSize int) (*Image, int, int, error) {
+	origWidth := src.Width()
+	origHeight := src.Height()
+	w, h := scaledSize(origWidth, origHeight, maxSize)
+
+	if w != origWidth || h != origHeight {
+		dst := opencv.Resize(src, w, h, 0)
+		src.Release()
+		src = dst
+	}
+
+	gray := opencv.CreateImage(w, h, opencv.IPL_DEPTH_8U, 1)
+	opencv.CvtColor(src, gray, opencv.CV_BGR2GRAY)
+
+	return &Image{ipl: gray, color: src}, origWidth, origHeight, nil
+}
+
+// CropBounds crops a single image into multiple defined by bounds.
+func CropBounds(img *Image, bounds []*image.Rectangle) ([]*Image, error) {
+	if err := checkBounds(bounds, img.Width(), img.Height()); err != nil {
+		return nil, err
+	}
+
+	imgs := make([]*Image, len(bounds))
+	for i, b := range bounds {
+		imgs[i] = &Image{ipl: opencv.Crop(img.ipl, b.Min.X, b.Min.Y, b.Dx(), b.Dy())}
+	}
+
+	return imgs, nil
+}
+
+// Canny the image, it stops with the error of ctx when ctx is done
+func Canny(ctx context.Context, src *Image, threshold, ratio float64, clone bool) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dst := src
+	if clone {
+		dst = &Image{ipl: src.ipl.Clone()}
+	}
+
+	if blur := minInt(src.Width(), src.Height()) / 20; blur != 0 {
+		opencv.Smooth(dst.ipl, dst.ipl, opencv.CV_BLUR, blur, blur, 0, 0)
+	}
+
+	opencv.Canny(dst.ipl, dst.ipl, threshold, threshold*ratio, 3)
+
+	return dst, nil
+}
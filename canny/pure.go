@@ -0,0 +1,297 @@
+//go:build !opencv
+// +build !opencv
+
+package canny
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+
+	// Register the formats opencv decodes as well
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Backend is the name of the backend the package is built with
+const Backend = "pure"
+
+// Image is a grayscale image. Images returned by Load also keep their
+// colors.
+type Image struct {
+	gray  *image.Gray
+	color *image.RGBA
+}
+
+func newImage(w, h int) *Image {
+	return &Image{gray: image.NewGray(image.Rect(0, 0, w, h))}
+}
+
+func fromPixels(pix []uint8, w, h int) *Image {
+	return &Image{gray: &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}}
+}
+
+// pixels returns a copy of the intensities of all pixels, row by row
+func (img *Image) pixels() []uint8 {
+	pix := make([]uint8, len(img.gray.Pix))
+	copy(pix, img.gray.Pix)
+	return pix
+}
+
+// Width of the image
+func (img *Image) Width() int { return img.gray.Rect.Dx() }
+
+// Height of the image
+func (img *Image) Height() int { return img.gray.Rect.Dy() }
+
+// At returns the intensity of the pixel at x, y
+func (img *Image) At(x, y int) uint8 {
+	return img.gray.Pix[img.gray.Stride*y+x]
+}
+
+// Mean intensity of all pixels
+func (img *Image) Mean() float64 {
+	if len(img.gray.Pix) == 0 {
+		return 0
+	}
+
+	sum := 0
+	for _, p := range img.gray.Pix {
+		sum += int(p)
+	}
+
+	return float64(sum) / float64(len(img.gray.Pix))
+}
+
+// Color returns the colors of an image returned by Load, nil otherwise
+func (img *Image) Color() image.Image {
+	if img.color == nil {
+		return nil
+	}
+
+	return img.color
+}
+
+// Release is a noop, it only exists to be compatible with the opencv backend
+func (img *Image) Release() {}
+
+// Load as grayscale en resize, the colors are kept as well
+func Load(reader io.Reader, maxSize int) (*Image, int, int, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, ErrLoadFailed
+	}
+
+	return FromImage(src, maxSize)
+}
+
+// FromImage converts a decoded image to grayscale and resizes it like Load,
+// the colors are kept as well
+func FromImage(src image.Image, maxSize int) (*Image, int, int, error) {
+	b := src.Bounds()
+	if b.Empty() {
+		return nil, 0, 0, ErrLoadFailed
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, src, b.Min, draw.Src)
+
+	origWidth := b.Dx()
+	origHeight := b.Dy()
+	w, h := scaledSize(origWidth, origHeight, maxSize)
+
+	if w != origWidth || h != origHeight {
+		rgba = resize(rgba, w, h)
+	}
+
+	img := newImage(w, h)
+	img.color = rgba
+	draw.Draw(img.gray, img.gray.Rect, rgba, image.ZP, draw.Src)
+
+	return img, origWidth, origHeight, nil
+}
+
+// resize src to w x h by averaging the source pixels covered by each
+// destination pixel
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw := src.Rect.Dx()
+	sh := src.Rect.Dy()
+
+	var sum [4]int
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := maxInt(y0+1, (y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := maxInt(x0+1, (x+1)*sw/w)
+
+			sum = [4]int{}
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					for c := range sum {
+						sum[c] += int(src.Pix[i+c])
+					}
+				}
+			}
+
+			n := (x1 - x0) * (y1 - y0)
+			i := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// CropBounds crops a single image into multiple defined by bounds.
+func CropBounds(img *Image, bounds []*image.Rectangle) ([]*Image, error) {
+	if err := checkBounds(bounds, img.Width(), img.Height()); err != nil {
+		return nil, err
+	}
+
+	imgs := make([]*Image, len(bounds))
+	for i, b := range bounds {
+		imgs[i] = newImage(b.Dx(), b.Dy())
+		for y := 0; y < b.Dy(); y++ {
+			copy(
+				imgs[i].gray.Pix[imgs[i].gray.Stride*y:imgs[i].gray.Stride*(y+1)],
+				img.gray.Pix[img.gray.Stride*(b.Min.Y+y)+b.Min.X:],
+			)
+		}
+	}
+
+	return imgs, nil
+}
+
+// Canny the image, it stops with the error of ctx when ctx is done
+func Canny(ctx context.Context, src *Image, threshold, ratio float64, clone bool) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dst := src
+	if clone {
+		dst = newImage(src.Width(), src.Height())
+		copy(dst.gray.Pix, src.gray.Pix)
+	}
+
+	if blur := minInt(src.Width(), src.Height()) / 20; blur != 0 {
+		boxBlur(dst.gray.Pix, dst.Width(), dst.Height(), blur)
+	}
+
+	edges, err := canny(ctx, dst, threshold, threshold*ratio)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(dst.gray.Pix, edges)
+
+	return dst, nil
+}
+
+// canny returns the edges of img as 255, everything else as 0. Like opencv
+// it uses a 3x3 sobel aperture and the L1 norm for gradient magnitudes.
+func canny(ctx context.Context, img *Image, low, high float64) ([]uint8, error) {
+	w := img.Width()
+	h := img.Height()
+	dx, dy, mag := sobel(img.gray.Pix, w, h)
+
+	magAt := func(x, y int) int {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return 0
+		}
+
+		return mag[w*y+x]
+	}
+
+	const (
+		none = iota
+		weak
+		strong
+	)
+
+	// Non maximum suppression
+	state := make([]uint8, w*h)
+	stack := make([]int, 0, w)
+	for y := 0; y < h; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < w; x++ {
+			i := w*y + x
+			m := mag[i]
+			if float64(m) <= low {
+				continue
+			}
+
+			ax := float64(absInt(dx[i]))
+			ay := float64(absInt(dy[i]))
+
+			var isMax bool
+			switch {
+			case ay < ax*0.4142135623730951:
+				isMax = m > magAt(x-1, y) && m >= magAt(x+1, y)
+			case ay > ax*2.414213562373095:
+				isMax = m > magAt(x, y-1) && m >= magAt(x, y+1)
+			default:
+				s := 1
+				if (dx[i] < 0) != (dy[i] < 0) {
+					s = -1
+				}
+
+				isMax = m > magAt(x-s, y-1) && m > magAt(x+s, y+1)
+			}
+
+			if !isMax {
+				continue
+			}
+
+			state[i] = weak
+			if float64(m) > high {
+				state[i] = strong
+				stack = append(stack, i)
+			}
+		}
+	}
+
+	// Hysteresis: keep weak edges connected to strong ones
+	for len(stack) != 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x := i % w
+		y := i / w
+
+		for ny := maxInt(0, y-1); ny <= minInt(h-1, y+1); ny++ {
+			for nx := maxInt(0, x-1); nx <= minInt(w-1, x+1); nx++ {
+				n := w*ny + nx
+				if state[n] == weak {
+					state[n] = strong
+					stack = append(stack, n)
+				}
+			}
+		}
+	}
+
+	edges := make([]uint8, w*h)
+	for i := range state {
+		if state[i] == strong {
+			edges[i] = 255
+		}
+	}
+
+	return edges, nil
+}
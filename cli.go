@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wieni/go-imgrect/imgrect"
+)
+
+// commands analyze local files or urls instead of starting the server,
+// see printUsage
+var commands = map[string]func(args []string) int{
+	"weighted": weightedCommand,
+	"bounded":  boundedCommand,
+}
+
+// imageExtensions are the files found in directories
+var imageExtensions = map[string]bool{
+	".gif":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+}
+
+// commandOutput receives the results of commands
+var commandOutput io.Writer = os.Stdout
+
+// commandResult is printed for every file, one per line
+type commandResult struct {
+	File string `json:"file"`
+	response
+}
+
+// boundsFlag collects every -b
+type boundsFlag []string
+
+func (b *boundsFlag) String() string { return strings.Join(*b, " ") }
+
+func (b *boundsFlag) Set(spec string) error {
+	*b = append(*b, spec)
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s weighted|bounded [flags] <file|dir|glob|url>...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands take the flags of the server as well, like -facecascade.\n\n")
+	fmt.Fprintf(os.Stderr, "Without a command the server is started:\n")
+	flag.PrintDefaults()
+}
+
+// parseArgs parses the flags in args, which may be mixed with files
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return files, nil
+		}
+
+		files = append(files, args[0])
+		args = args[1:]
+	}
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// expandPaths resolves globs and walks directories for images
+func expandPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if isURL(arg) {
+			paths = append(paths, arg)
+			continue
+		}
+
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No files match %s", arg)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				paths = append(paths, match)
+				continue
+			}
+
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if !info.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(path))] {
+					paths = append(paths, path)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// commandSource reads the file at path or refers to the url
+func commandSource(path string) (*fileSource, error) {
+	if isURL(path) {
+		return &fileSource{URL: path}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSource{data: data}, nil
+}
+
+// runCommand runs fn for every file in args and prints the results, it
+// returns the exit code. preview is nil for commands without a preview.
+// The settings of the server apply to commands as well, so they analyze
+// files like the server does.
+func runCommand(
+	fs *flag.FlagSet,
+	args []string,
+	preview *string,
+	fn func(source *fileSource, preview io.Writer) (interface{}, *requestError),
+) int {
+	if preview == nil {
+		preview = new(string)
+	}
+
+	configPath := fs.String("config", os.Getenv(envName("config")), "YAML file with the settings of the server.")
+	cfg.register(fs)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+
+	if err := loadConfig(fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := cfg.apply(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	paths, err := expandPaths(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	switch {
+	case len(paths) == 0:
+		fmt.Fprintln(os.Stderr, "No files given")
+		return 2
+	case *preview != "" && len(paths) > 1:
+		fmt.Fprintln(os.Stderr, "A preview can only be written for a single file")
+		return 2
+	}
+
+	code := 0
+	enc := json.NewEncoder(commandOutput)
+	for _, path := range paths {
+		res := &commandResult{File: path}
+		source, err := commandSource(path)
+		if err != nil {
+			res.Error = &requestError{"unreadable_file", "image", err.Error()}
+		} else if *preview != "" {
+			res.Error = writePreview(*preview, func(w io.Writer) *requestError {
+				_, rerr := fn(source, w)
+				return rerr
+			})
+		} else {
+			res.Msg, res.Error = fn(source, nil)
+		}
+
+		if res.Error != nil {
+			code = 1
+		}
+
+		if err := enc.Encode(res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	return code
+}
+
+// writePreview creates the preview file and passes it to fn
+func writePreview(path string, fn func(w io.Writer) *requestError) *requestError {
+	file, err := os.Create(path)
+	if err != nil {
+		return &requestError{"unreadable_file", "preview", err.Error()}
+	}
+
+	rerr := fn(file)
+	if err := file.Close(); err != nil && rerr == nil {
+		rerr = &requestError{"unreadable_file", "preview", err.Error()}
+	}
+
+	return rerr
+}
+
+func weightedCommand(args []string) int {
+	fs := flag.NewFlagSet("weighted", flag.ContinueOnError)
+	req := &weightedRequest{}
+	fs.Float64Var(&req.Width, "w", 1, "Minimum width of each rectangle in pixels or percentage of the width.")
+	fs.Float64Var(&req.Height, "h", 1, "Minimum height of each rectangle in pixels or percentage of the height.")
+	fs.Float64Var(&req.MinAspect, "minaspect", 0, "Minimum width / height ratio of each rectangle.")
+	fs.Float64Var(&req.MaxAspect, "maxaspect", 0, "Maximum width / height ratio of each rectangle.")
+	fs.Float64Var(&req.Aspect, "aspect", 0, "Exact width / height ratio of each rectangle.")
+	fs.IntVar(&req.Padding.Top, "pt", 0, "Padding top in pixels.")
+	fs.IntVar(&req.Padding.Right, "pr", 0, "Padding right in pixels.")
+	fs.IntVar(&req.Padding.Bottom, "pb", 0, "Padding bottom in pixels.")
+	fs.IntVar(&req.Padding.Left, "pl", 0, "Padding left in pixels.")
+	var regions boundsFlag
+	fs.Var(&regions, "r", "A region x1,y1,x2,y2 in pixels or percentages to search instead of the whole image, may be repeated.")
+	var keepOut boundsFlag
+	fs.Var(&keepOut, "k", "A keep out rectangle x1,y1,x2,y2 in pixels or percentages, may be repeated.")
+	mask := fs.String("mask", "", "A png file or url of which light pixels are kept out.")
+	font := fs.String("font", "", "A ttf font file or url.")
+	fs.Float64Var(&req.FontSize, "fontsize", 0, "Font size of the text.")
+	fs.BoolVar(&req.Fit, "fit", false, "Find the largest font size at which text fits in a rectangle.")
+	fs.Float64Var(&req.MinFontSize, "minfontsize", 0, "Smallest font size when fitting text.")
+	fs.Float64Var(&req.MaxFontSize, "maxfontsize", 0, "Largest font size when fitting text.")
+	fs.StringVar(&req.Text, "text", "", "Text to place.")
+	fs.IntVar(&req.MaxLines, "maxlines", 0, "Wrap text into at most this many lines.")
+	fs.Float64Var(&req.LineHeight, "lineheight", 0, "Line height in multiples of the font size.")
+	fs.StringVar(&req.Align, "align", "", "Alignment of wrapped lines: left, center or right.")
+	fs.IntVar(&req.N, "n", 0, "Amount of rectangles to return.")
+	fs.IntVar(&req.Min, "min", 0, "Minimum amount of rectangles.")
+	fs.StringVar(&req.Detector, "detector", "", "Detector of busy areas: canny, sobel, laplacian or entropy.")
+	fs.StringVar(&req.Composition, "composition", "", "Prefer rectangles near the center or thirds.")
+	fs.StringVar(&req.Gravity, "gravity", "", "Prefer rectangles near n, ne, e, se, s, sw, w, nw or the center.")
+	fs.Float64Var(&req.Snap, "snap", 0, "Snap edges within this many pixels or percentage of the size to the border of the gravity.")
+	fs.StringVar(&req.Faces, "faces", "", "Protect faces: drop or penalize rectangles that overlap them.")
+	preview := fs.String("preview", "", "Write a preview to this jpeg file, for a single file only.")
+
+	return runCommand(fs, args, preview, func(source *fileSource, preview io.Writer) (interface{}, *requestError) {
+		req.Image = source
+		if *font != "" && req.Font == nil {
+			var err error
+			req.Font, err = commandSource(*font)
+			if err != nil {
+				return nil, &requestError{"unreadable_file", "font", err.Error()}
+			}
+		}
+
+		if *mask != "" && req.Mask == nil {
+			var err error
+			req.Mask, err = commandSource(*mask)
+			if err != nil {
+				return nil, &requestError{"unreadable_file", "mask", err.Error()}
+			}
+		}
+
+		req.Regions = nil
+		for i, spec := range regions {
+			bounds, rerr := parseRect(fmt.Sprintf("r%d", i), spec)
+			if rerr != nil {
+				return nil, rerr
+			}
+
+			req.Regions = append(req.Regions, &searchRegion{Bounds: bounds})
+		}
+
+		req.KeepOut = nil
+		for i, spec := range keepOut {
+			values, rerr := parseRect(fmt.Sprintf("k%d", i), spec)
+			if rerr != nil {
+				return nil, rerr
+			}
+
+			req.KeepOut = append(req.KeepOut, values)
+		}
+
+		if rerr := req.validate(); rerr != nil {
+			return nil, rerr
+		}
+
+		msg, herr := runWeighted(context.Background(), req, preview)
+		if herr != nil {
+			return nil, herr.requestError()
+		}
+
+		return msg, nil
+	})
+}
+
+func boundedCommand(args []string) int {
+	fs := flag.NewFlagSet("bounded", flag.ContinueOnError)
+	var specs boundsFlag
+	fs.Var(&specs, "b", "A bound x1,y1,x2,y2 in pixels or percentages, at least 2.")
+
+	return runCommand(fs, args, nil, func(source *fileSource, preview io.Writer) (interface{}, *requestError) {
+		switch {
+		case len(specs) < 2:
+			return nil, &requestError{"too_few_bounds", "b", "At least 2 bounds are required"}
+		case len(specs) > cfg.MaxBounds:
+			return nil, &requestError{"too_many_bounds", "b", fmt.Sprintf("At most %d bounds are allowed", cfg.MaxBounds)}
+		}
+
+		rects := make([]*imgrect.PercentRectangle, len(specs))
+		for i, spec := range specs {
+			rect, rerr := parseBound(fmt.Sprintf("b%d", i), spec)
+			if rerr != nil {
+				return nil, rerr
+			}
+
+			rects[i] = rect
+		}
+
+		msg, herr := runBounded(context.Background(), source, rects)
+		if herr != nil {
+			return nil, herr.requestError()
+		}
+
+		return msg, nil
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeFiles creates empty files at the paths relative to dir
+func writeFiles(t *testing.T, dir string, paths ...string) {
+	for _, path := range paths {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "a.png", "b.JPG", "notes.txt", "sub/c.gif", "sub/d.jpeg", "sub/e.webp")
+	join := func(paths ...string) []string {
+		for i := range paths {
+			paths[i] = filepath.Join(dir, paths[i])
+		}
+
+		return paths
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"dir", []string{dir}, join("a.png", "b.JPG", "sub/c.gif", "sub/d.jpeg")},
+		{"glob", []string{filepath.Join(dir, "*.png")}, join("a.png")},
+		{"glob of dirs", []string{filepath.Join(dir, "s*")}, join("sub/c.gif", "sub/d.jpeg")},
+		{"file", join("notes.txt"), join("notes.txt")},
+		{"url", []string{"https://example.com/a.png"}, []string{"https://example.com/a.png"}},
+	}
+
+	for _, test := range tests {
+		got, err := expandPaths(test.args)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	for _, arg := range []string{filepath.Join(dir, "*.bmp"), filepath.Join(dir, "missing.png")} {
+		if _, err := expandPaths([]string{arg}); err == nil {
+			t.Errorf("%s: expected an error", arg)
+		}
+	}
+}
+
+func TestWeightedCommand(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewGray(image.Rect(0, 0, 120, 80))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+
+	for x := 0; x < 120; x++ {
+		img.SetGray(x, 40, color.Gray{})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "image.png"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, "empty.png")
+
+	var out bytes.Buffer
+	commandOutput = &out
+	defer func() { commandOutput = os.Stdout }()
+
+	if code := weightedCommand([]string{dir, "-w", "10", "-h", "10", "-n", "2"}); code != 1 {
+		t.Errorf("Exit code %d, want 1 for a file that is not an image", code)
+	}
+
+	// One result per line, in the order of the files
+	type result struct {
+		File string `json:"file"`
+		Msg  *struct {
+			Rects []json.RawMessage `json:"rects"`
+		} `json:"msg"`
+		Error *requestError `json:"error"`
+	}
+
+	var results []result
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var res result
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+
+		results = append(results, res)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Got %d results, want 2: %s", len(results), out.String())
+	}
+
+	empty, valid := results[0], results[1]
+	if empty.File != filepath.Join(dir, "empty.png") || empty.Error == nil || empty.Error.Code != "not_an_image" {
+		t.Errorf("Got %+v for the empty file, want not_an_image", empty)
+	}
+
+	if valid.File != filepath.Join(dir, "image.png") || valid.Error != nil || valid.Msg == nil || len(valid.Msg.Rects) != 2 {
+		t.Errorf("Got %+v for the image, want 2 rectangles", valid)
+	}
+}
+
+func TestCommandSettings(t *testing.T) {
+	defer cfg.apply()
+	defer func(old string) { cfg.FaceCascade = old }(cfg.FaceCascade)
+
+	// The settings of the server are applied, a cascade that can not be
+	// loaded stops the command
+	dir := t.TempDir()
+	code := weightedCommand([]string{"-facecascade", filepath.Join(dir, "missing.xml"), dir})
+	if code != 2 {
+		t.Errorf("Exit code %d, want 2", code)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wieni/go-imgrect/canny"
+	"github.com/wieni/go-imgrect/imgrect"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is prepended to the upper cased flag names to get the
+// environment variables
+const envPrefix = "IMGRECT_"
+
+// config contains the settings of the server. Every setting is a flag, it
+// can also be set in the config file or environment. Flags take precedence
+// over the environment, which takes precedence over the file.
+type config struct {
+	Port           int
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	ProcessTimeout time.Duration
+	CORS           corsPolicy
+	Debug          bool
+	LogLevel       string
+
+	MaxFormSize      int64
+	MaxImageSize     int
+	MaxBounds        int
+	Amount           int
+	MaxAmount        int
+	SoftMaxThreshold float64
+	MaxThreshold     float64
+	FaceCascade      string
+
+	CacheSize    int
+	CacheDir     string
+	CacheDirSize int64
+
+	FetchTimeout   time.Duration
+	FetchSize      int64
+	FetchRedirects int
+	Schemes        []string
+	AllowHosts     []string
+	DenyHosts      []string
+	AllowPrivate   bool
+}
+
+var cfg = &config{
+	Port:           8080,
+	ReadTimeout:    time.Second * 10,
+	WriteTimeout:   time.Second * 10,
+	ProcessTimeout: time.Second * 8,
+	CORS: corsPolicy{
+		Origins: []string{"*"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Content-Type", "X-Request-ID"},
+		MaxAge:  time.Minute * 10,
+	},
+	LogLevel: "info",
+
+	MaxFormSize:      60 << 20,
+	MaxImageSize:     imgrect.DefaultMaxImageSize,
+	MaxBounds:        20,
+	Amount:           imgrect.DefaultAmount,
+	MaxAmount:        20,
+	SoftMaxThreshold: imgrect.DefaultSoftMaxThreshold,
+	MaxThreshold:     imgrect.DefaultMaxThreshold,
+
+	CacheSize:    256,
+	CacheDirSize: 1 << 30,
+
+	FetchTimeout:   time.Second * 10,
+	FetchSize:      60 << 20,
+	FetchRedirects: 5,
+	Schemes:        []string{"http", "https"},
+}
+
+// listFlag is a comma separated list
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.list = splitList(value)
+	return nil
+}
+
+// register the flags of all settings in fs
+func (c *config) register(fs *flag.FlagSet) {
+	fs.IntVar(&c.Port, "p", c.Port, "Port to listen on.")
+	fs.DurationVar(&c.ReadTimeout, "readtimeout", c.ReadTimeout, "Timeout for reading requests.")
+	fs.DurationVar(&c.WriteTimeout, "writetimeout", c.WriteTimeout, "Timeout for writing responses.")
+	fs.DurationVar(&c.ProcessTimeout, "timeout", c.ProcessTimeout, "Maximum processing time of a request, 0 disables it.")
+	fs.Var(listFlag{&c.CORS.Origins}, "origins", "Comma separated origins allowed by CORS, * allows all.")
+	fs.Var(listFlag{&c.CORS.Methods}, "corsmethods", "Comma separated methods allowed by CORS.")
+	fs.Var(listFlag{&c.CORS.Headers}, "corsheaders", "Comma separated request headers allowed by CORS, * allows all.")
+	fs.DurationVar(&c.CORS.MaxAge, "corsmaxage", c.CORS.MaxAge, "Time browsers may cache CORS preflight responses, 0 leaves it to the browser.")
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "Serve the effective configuration at /config.")
+	fs.StringVar(&c.LogLevel, "loglevel", c.LogLevel, "Level of the request logs: debug, info, warn or error.")
+
+	fs.Int64Var(&c.MaxFormSize, "maxformsize", c.MaxFormSize, "Maximum size in bytes of request bodies.")
+	fs.IntVar(&c.MaxImageSize, "maximagesize", c.MaxImageSize, "Size in pixels images are scaled down to.")
+	fs.IntVar(&c.MaxBounds, "maxbounds", c.MaxBounds, "Maximum amount of bounds of /bounded.")
+	fs.IntVar(&c.Amount, "amount", c.Amount, "Amount of rectangles /weighted returns by default.")
+	fs.IntVar(&c.MaxAmount, "maxamount", c.MaxAmount, "Maximum amount of rectangles /weighted returns.")
+	fs.Float64Var(&c.SoftMaxThreshold, "softmaxthreshold", c.SoftMaxThreshold, "Detector threshold above which only too few rectangles are searched.")
+	fs.Float64Var(&c.MaxThreshold, "maxthreshold", c.MaxThreshold, "Maximum detector threshold.")
+	fs.StringVar(&c.FaceCascade, "facecascade", c.FaceCascade, "Opencv haar cascade file used to detect faces, the bundled frontal face cascade by default.")
+
+	fs.IntVar(&c.CacheSize, "cache", c.CacheSize, "Amount of results to cache in memory, 0 disables caching.")
+	fs.StringVar(&c.CacheDir, "cachedir", c.CacheDir, "Directory to cache results in, next to the memory.")
+	fs.Int64Var(&c.CacheDirSize, "cachedirsize", c.CacheDirSize, "Maximum size in bytes of -cachedir, the least recently used results are removed.")
+
+	fs.DurationVar(&c.FetchTimeout, "fetchtimeout", c.FetchTimeout, "Timeout for fetching urls.")
+	fs.Int64Var(&c.FetchSize, "fetchsize", c.FetchSize, "Maximum size in bytes of fetched files.")
+	fs.IntVar(&c.FetchRedirects, "fetchredirects", c.FetchRedirects, "Maximum amount of redirects when fetching urls.")
+	fs.Var(listFlag{&c.Schemes}, "schemes", "Comma separated schemes urls may use.")
+	fs.Var(listFlag{&c.AllowHosts}, "allowhosts", "Comma separated hosts urls may point to, *.example.com matches subdomains. All by default.")
+	fs.Var(listFlag{&c.DenyHosts}, "denyhosts", "Comma separated hosts urls may not point to.")
+	fs.BoolVar(&c.AllowPrivate, "allowprivate", c.AllowPrivate, "Allow fetching urls from private and loopback addresses.")
+}
+
+// envName returns the environment variable of a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(name)
+}
+
+// readConfigFile reads the settings in a YAML file, its keys are the names
+// of the flags
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, name)
+		}
+
+		if list, ok := value.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i := range list {
+				items[i] = fmt.Sprint(list[i])
+			}
+
+			values[name] = strings.Join(items, ",")
+			continue
+		}
+
+		values[name] = fmt.Sprint(value)
+	}
+
+	return values, nil
+}
+
+// loadConfig applies the config file at path and the environment to the
+// flags of fs that were not set on the command line
+func loadConfig(fs *flag.FlagSet, path string) error {
+	values := map[string]string{}
+	if path != "" {
+		var err error
+		values, err = readConfigFile(fs, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = value
+		}
+	})
+
+	fs.Visit(func(f *flag.Flag) {
+		delete(values, f.Name)
+	})
+
+	for name, value := range values {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validate the settings
+func (c *config) validate() error {
+	var level slog.Level
+	switch {
+	case c.Port < 1 || c.Port > 65535:
+		return errors.New("p: Must be between 1 and 65535")
+	case c.ReadTimeout <= 0:
+		return errors.New("readtimeout: Must be positive")
+	case c.WriteTimeout <= 0:
+		return errors.New("writetimeout: Must be positive")
+	case c.ProcessTimeout < 0:
+		return errors.New("timeout: Must not be negative")
+	case level.UnmarshalText([]byte(c.LogLevel)) != nil:
+		return errors.New("loglevel: Must be one of debug, info, warn, error")
+	case c.MaxFormSize <= 0:
+		return errors.New("maxformsize: Must be positive")
+	case c.MaxImageSize < 1:
+		return errors.New("maximagesize: Must be positive")
+	case c.MaxBounds < 2:
+		return errors.New("maxbounds: Must be at least 2")
+	case c.MaxAmount < 1:
+		return errors.New("maxamount: Must be positive")
+	case c.Amount < 1 || c.Amount > c.MaxAmount:
+		return fmt.Errorf("amount: Must be between 1 and %d", c.MaxAmount)
+	case c.MaxThreshold <= 0:
+		return errors.New("maxthreshold: Must be positive")
+	case c.SoftMaxThreshold <= 0 || c.SoftMaxThreshold > c.MaxThreshold:
+		return errors.New("softmaxthreshold: Must be positive and not larger than maxthreshold")
+	case c.CacheSize < 0:
+		return errors.New("cache: Must not be negative")
+	case c.CacheDirSize <= 0:
+		return errors.New("cachedirsize: Must be positive")
+	case c.FetchTimeout <= 0:
+		return errors.New("fetchtimeout: Must be positive")
+	case c.FetchSize <= 0:
+		return errors.New("fetchsize: Must be positive")
+	case c.FetchRedirects < 0:
+		return errors.New("fetchredirects: Must not be negative")
+	case len(c.Schemes) == 0:
+		return errors.New("schemes: At least 1 scheme is required")
+	}
+
+	for _, s := range c.Schemes {
+		if s != "http" && s != "https" {
+			return fmt.Errorf("schemes: %s is not supported, use http or https", s)
+		}
+	}
+
+	return c.CORS.validate()
+}
+
+// faceCascade is the cascade of -facecascade, nil for the bundled one
+var faceCascade *canny.Cascade
+
+// loadCascade parses the haar cascade file at path, it returns the hash of
+// the file as well
+func loadCascade(path string) (*canny.Cascade, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	c, err := canny.ParseCascade(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return c, hex.EncodeToString(sum[:]), nil
+}
+
+// apply the settings to the parts of the server that keep their own
+func (c *config) apply() error {
+	var err error
+	results, err = newResultCache(c.CacheSize, c.CacheDir, c.CacheDirSize)
+	if err != nil {
+		return err
+	}
+
+	resultSettings = cacheSettings{
+		Version:          responseVersion,
+		Backend:          canny.Backend,
+		MaxImageSize:     c.MaxImageSize,
+		SoftMaxThreshold: c.SoftMaxThreshold,
+		MaxThreshold:     c.MaxThreshold,
+	}
+
+	faceCascade = nil
+	if c.FaceCascade != "" {
+		faceCascade, resultSettings.FaceCascade, err = loadCascade(c.FaceCascade)
+		if err != nil {
+			return fmt.Errorf("facecascade: %v", err)
+		}
+	}
+
+	if err := logLevel.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return err
+	}
+
+	defaultFetcher.Timeout = c.FetchTimeout
+	defaultFetcher.MaxSize = c.FetchSize
+	defaultFetcher.MaxRedirects = c.FetchRedirects
+	defaultFetcher.Schemes = c.Schemes
+	defaultFetcher.AllowHosts = c.AllowHosts
+	defaultFetcher.DenyHosts = c.DenyHosts
+	defaultFetcher.AllowPrivate = c.AllowPrivate
+	return nil
+}
+
+// serveConfig shows the effective settings by the names of their flags
+func serveConfig(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
+	settings := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			settings[f.Name] = f.Value.String()
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return 0, json.NewEncoder(w).Encode(&response{Msg: settings})
+}
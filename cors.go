@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allowedMethods are the methods the router serves
+var allowedMethods = []string{"GET", "POST", "OPTIONS"}
+
+// corsPolicy decides which cross origin requests browsers may make
+type corsPolicy struct {
+	// Origins allowed to make requests, * allows all
+	Origins []string
+	// Methods allowed in requests
+	Methods []string
+	// Headers clients may send, * allows all
+	Headers []string
+	// MaxAge browsers may cache preflight responses, 0 leaves it to the
+	// browser
+	MaxAge time.Duration
+}
+
+// contains reports whether list contains value, ignoring case
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsOrigin reports whether requests from origin are allowed
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	return contains(p.Origins, "*") || contains(p.Origins, origin)
+}
+
+// allowsMethod reports whether requests with method are allowed
+func (p *corsPolicy) allowsMethod(method string) bool {
+	return contains(p.Methods, method)
+}
+
+// disallowedHeader returns the first header of a comma separated list that
+// may not be sent, or an empty string when all are allowed
+func (p *corsPolicy) disallowedHeader(headers string) string {
+	if contains(p.Headers, "*") {
+		return ""
+	}
+
+	for _, header := range splitList(headers) {
+		if !contains(p.Headers, header) {
+			return header
+		}
+	}
+
+	return ""
+}
+
+// validate the policy
+func (p *corsPolicy) validate() error {
+	for _, origin := range p.Origins {
+		if origin != "*" && !isOrigin(origin) {
+			return fmt.Errorf("origins: %s is not * or an origin like https://example.com", origin)
+		}
+	}
+
+	for _, method := range p.Methods {
+		if !contains(allowedMethods, method) {
+			return fmt.Errorf("corsmethods: %s is not one of %s", method, strings.Join(allowedMethods, ", "))
+		}
+	}
+
+	if p.MaxAge < 0 {
+		return fmt.Errorf("corsmaxage: Must not be negative")
+	}
+
+	return nil
+}
+
+// isOrigin reports whether origin is a scheme and host without a path
+func isOrigin(origin string) bool {
+	scheme, host, ok := strings.Cut(origin, "://")
+	return ok && scheme != "" && host != "" && !strings.ContainsAny(host, "/?#")
+}
+
+// setHeaders adds the headers that allow a browser to read the response
+// to r. Responses differ per origin unless all origins are allowed.
+func (p *corsPolicy) setHeaders(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	if contains(p.Origins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && p.allowsOrigin(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+
+	h.Set("Access-Control-Expose-Headers", "X-Request-ID")
+}
+
+// servePreflight answers OPTIONS requests. Preflight requests of browsers
+// get the allowed methods and headers, or 403 when the request they
+// announce is not allowed.
+func servePreflight(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
+	h := w.Header()
+	h.Set("Allow", strings.Join(allowedMethods, ", "))
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	p := &cfg.CORS
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	switch {
+	case !p.allowsOrigin(origin):
+		return writeError(w, http.StatusForbidden, &requestError{"origin_not_allowed", "Origin", fmt.Sprintf("Origin %s is not allowed", origin)})
+	case !p.allowsMethod(method):
+		return writeError(w, http.StatusForbidden, &requestError{"method_not_allowed", "Access-Control-Request-Method", fmt.Sprintf("Method %s is not allowed", method)})
+	}
+
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if header := p.disallowedHeader(headers); header != "" {
+		return writeError(w, http.StatusForbidden, &requestError{"header_not_allowed", "Access-Control-Request-Headers", fmt.Sprintf("Header %s is not allowed", header)})
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+	if headers != "" {
+		allowed := strings.Join(p.Headers, ", ")
+		if contains(p.Headers, "*") {
+			allowed = headers
+		}
+
+		h.Set("Access-Control-Allow-Headers", allowed)
+	}
+
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve passes r through the router like the server does
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	fn, _ := router(r, log.Default())
+	fn(w, r, log.Default())
+	return w
+}
+
+// preflight sends the OPTIONS request a browser sends before a cross origin
+// request with method and headers
+func preflight(path, origin, method, headers string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("OPTIONS", path, nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+
+	return serve(r)
+}
+
+// withCORS replaces the CORS policy until the test ends
+func withCORS(t *testing.T, p corsPolicy) {
+	old := cfg.CORS
+	cfg.CORS = p
+	t.Cleanup(func() { cfg.CORS = old })
+}
+
+// checkHeaders compares the headers of w to want, an empty value means the
+// header may not be set
+func checkHeaders(t *testing.T, w *httptest.ResponseRecorder, want map[string]string) {
+	t.Helper()
+	for name, value := range want {
+		got := strings.Join(w.Header().Values(name), ", ")
+		if got != value {
+			t.Errorf("%s: got %q, want %q", name, got, value)
+		}
+	}
+}
+
+// checkError compares the status and error code of w
+func checkError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("Status %d, want %d", w.Code, status)
+	}
+
+	if !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+		t.Errorf("Body %s, want code %s", w.Body.String(), code)
+	}
+}
+
+func TestCORSAllOrigins(t *testing.T) {
+	withCORS(t, corsPolicy{
+		Origins: []string{"*"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Content-Type"},
+		MaxAge:  time.Minute * 10,
+	})
+
+	w := preflight("/weighted", "https://app.example.com", "POST", "content-type")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Preflight status %d, want 204", w.Code)
+	}
+
+	checkHeaders(t, w, map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Access-Control-Request-Method, Access-Control-Request-Headers",
+	})
+
+	r := httptest.NewRequest("POST", "/weighted", strings.NewReader("{}"))
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Content-Type", "application/json")
+	w = serve(r)
+	checkError(t, w, http.StatusNotAcceptable, "required")
+	checkHeaders(t, w, map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Expose-Headers": "X-Request-ID",
+		"Access-Control-Allow-Methods":  "",
+		"Vary":                          "",
+	})
+}
+
+func TestCORSOrigins(t *testing.T) {
+	withCORS(t, corsPolicy{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Content-Type", "X-Request-ID"},
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		w := preflight("/bounded", "https://app.example.com", "GET", "X-Request-ID")
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Preflight status %d, want 204", w.Code)
+		}
+
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "GET, POST",
+			"Access-Control-Allow-Headers": "Content-Type, X-Request-ID",
+			"Access-Control-Max-Age":       "",
+			"Vary":                         "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+		})
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		w = serve(r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Status %d, want 200", w.Code)
+		}
+
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Origin":   "https://app.example.com",
+			"Access-Control-Expose-Headers": "X-Request-ID",
+			"Vary":                          "Origin",
+		})
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		w := preflight("/bounded", "https://evil.example.com", "GET", "")
+		checkError(t, w, http.StatusForbidden, "origin_not_allowed")
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+			"Vary":                         "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+		})
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		w = serve(r)
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Vary":                        "Origin",
+		})
+	})
+
+	t.Run("disallowed method", func(t *testing.T) {
+		w := preflight("/weighted", "https://app.example.com", "DELETE", "")
+		checkError(t, w, http.StatusForbidden, "method_not_allowed")
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "",
+		})
+	})
+
+	t.Run("disallowed headers", func(t *testing.T) {
+		w := preflight("/weighted", "https://app.example.com", "POST", "Content-Type, X-Secret")
+		checkError(t, w, http.StatusForbidden, "header_not_allowed")
+		checkHeaders(t, w, map[string]string{
+			"Access-Control-Allow-Methods": "",
+			"Access-Control-Allow-Headers": "",
+		})
+	})
+}
+
+func TestCORSRoutes(t *testing.T) {
+	// Requests without Origin are not preflights
+	w := serve(httptest.NewRequest("OPTIONS", "/weighted", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("OPTIONS status %d, want 204", w.Code)
+	}
+
+	checkHeaders(t, w, map[string]string{"Allow": "GET, POST, OPTIONS"})
+
+	w = preflight("/unknown", "https://app.example.com", "GET", "")
+	checkError(t, w, http.StatusNotFound, "not_found")
+
+	w = serve(httptest.NewRequest("PUT", "/weighted", nil))
+	checkError(t, w, http.StatusMethodNotAllowed, "method_not_allowed")
+}
+
+func TestMetricsRoute(t *testing.T) {
+	withCORS(t, corsPolicy{Origins: []string{"*"}, Methods: []string{"GET"}})
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		w := serve(r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status %d, want 200", w.Code)
+		}
+
+		if w.Header().Get("X-Request-ID") == "" {
+			t.Error("Missing X-Request-ID")
+		}
+
+		checkHeaders(t, w, map[string]string{"Access-Control-Allow-Origin": "*"})
+
+		// The first scrape is counted like any other request
+		if i == 1 && !strings.Contains(w.Body.String(), `route="metrics"`) {
+			t.Error("Scrapes of /metrics are not counted")
+		}
+	}
+}
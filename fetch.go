@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fetchError is returned when fetching a url fails, it is reported with
+// status and a machine readable code
+type fetchError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *fetchError) Error() string { return e.msg }
+
+func newFetchError(status int, code, format string, args ...interface{}) *fetchError {
+	return &fetchError{status, code, fmt.Sprintf(format, args...)}
+}
+
+// media describes the kind of file expected from a url
+type media struct {
+	// ContentTypes the content type has to start with
+	ContentTypes []string
+	// Code of the error when the content type does not match
+	Code string
+}
+
+var (
+	imageMedia = &media{[]string{"image/"}, "not_an_image"}
+	fontMedia  = &media{
+		[]string{
+			"font/",
+			"application/font-",
+			"application/x-font-",
+			"application/vnd.ms-opentype",
+			// Not all fonts are recognized by http.DetectContentType
+			"application/octet-stream",
+		},
+		"not_a_font",
+	}
+)
+
+func (m *media) accepts(contentType string) bool {
+	for _, t := range m.ContentTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errPrivateAddress is returned by the dialer when a host resolves to an
+// address that is not publicly routable
+var errPrivateAddress = errors.New("Private address")
+
+// fetcher downloads images and fonts for the url parameters. It refuses to
+// connect to private addresses, so the server can not be used to probe the
+// network it runs in.
+type fetcher struct {
+	// Schemes that may be fetched
+	Schemes []string
+	// AllowHosts restricts fetching to these hosts when not empty,
+	// *.example.com matches all subdomains of example.com
+	AllowHosts []string
+	// DenyHosts may never be fetched, they match like AllowHosts
+	DenyHosts []string
+	// AllowPrivate allows fetching from private and loopback addresses
+	AllowPrivate bool
+	MaxRedirects int
+	Timeout      time.Duration
+	// MaxSize of a response body in bytes
+	MaxSize int64
+
+	// client is built from the settings above by the first fetch, they
+	// may not change after it
+	client     *http.Client
+	clientOnce sync.Once
+}
+
+var defaultFetcher = &fetcher{
+	Schemes:      []string{"http", "https"},
+	MaxRedirects: 5,
+	Timeout:      time.Second * 10,
+	MaxSize:      60 << 20,
+}
+
+// isPublicIP reports whether ip is a publicly routable unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	// Carrier grade NAT, 100.64.0.0/10
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+
+	return true
+}
+
+// matchHost reports whether host matches any of the patterns
+func matchHost(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+
+			continue
+		}
+
+		if host == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkURL validates the scheme and host of u
+func (f *fetcher) checkURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	allowed := false
+	for _, s := range f.Schemes {
+		if scheme == s {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return newFetchError(http.StatusBadRequest, "scheme_not_allowed", "Scheme %q is not allowed", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return newFetchError(http.StatusBadRequest, "invalid_url", "Missing host")
+	}
+
+	if matchHost(host, f.DenyHosts) ||
+		(len(f.AllowHosts) != 0 && !matchHost(host, f.AllowHosts)) {
+		return newFetchError(http.StatusForbidden, "host_not_allowed", "Host %s is not allowed", host)
+	}
+
+	return nil
+}
+
+// control refuses connections to private addresses after they have been
+// resolved, which also covers DNS rebinding and redirects
+func (f *fetcher) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errPrivateAddress
+	}
+
+	return nil
+}
+
+func (f *fetcher) httpClient() *http.Client {
+	f.clientOnce.Do(f.buildClient)
+	return f.client
+}
+
+// buildClient creates the http client of the settings of f
+func (f *fetcher) buildClient() {
+	dialer := &net.Dialer{Timeout: f.Timeout}
+	if !f.AllowPrivate {
+		dialer.Control = f.control
+	}
+
+	f.client = &http.Client{
+		Timeout: f.Timeout,
+		Transport: &http.Transport{
+			// A proxy would be dialed instead of the host
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   f.Timeout,
+			ResponseHeaderTimeout: f.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.MaxRedirects {
+				return newFetchError(
+					http.StatusBadGateway,
+					"too_many_redirects",
+					"More than %d redirects",
+					f.MaxRedirects,
+				)
+			}
+
+			return f.checkURL(req.URL)
+		},
+	}
+}
+
+// toFetchError translates errors of the http client to fetch errors
+func toFetchError(err error) error {
+	var ferr *fetchError
+	if errors.As(err, &ferr) {
+		return ferr
+	}
+
+	if errors.Is(err, errPrivateAddress) {
+		return newFetchError(http.StatusForbidden, "private_address", "Private addresses are not allowed")
+	}
+
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+		return newFetchError(http.StatusGatewayTimeout, "upstream_timeout", "Timeout fetching url")
+	}
+
+	return newFetchError(http.StatusBadGateway, "upstream_error", "Failed to fetch url: %s", err)
+}
+
+// fetch downloads rawURL, which has to be of the given media. The status,
+// content type and size of the response are checked before its body is
+// read. It stops with the error of ctx when ctx is done.
+func (f *fetcher) fetch(ctx context.Context, rawURL string, m *media) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, newFetchError(http.StatusBadRequest, "invalid_url", "Invalid url")
+	}
+
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	defer func() {
+		fetchDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, newFetchError(http.StatusBadRequest, "invalid_url", "Invalid url")
+	}
+
+	resp, err := f.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, toFetchError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newFetchError(
+			http.StatusFailedDependency,
+			"upstream_status",
+			"Url responded with %s",
+			resp.Status,
+		)
+	}
+
+	// Servers often send files as octet-stream, those are sniffed below
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType != "" &&
+		contentType != "application/octet-stream" &&
+		contentType != "binary/octet-stream" &&
+		!m.accepts(contentType) {
+		return nil, newFetchError(
+			http.StatusUnsupportedMediaType,
+			m.Code,
+			"Unsupported content type %s",
+			contentType,
+		)
+	}
+
+	if resp.ContentLength > f.MaxSize {
+		return nil, newFetchError(
+			http.StatusRequestEntityTooLarge,
+			"file_too_large",
+			"Url is larger than %d bytes",
+			f.MaxSize,
+		)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxSize+1))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, toFetchError(err)
+	}
+
+	if int64(len(data)) > f.MaxSize {
+		return nil, newFetchError(
+			http.StatusRequestEntityTooLarge,
+			"file_too_large",
+			"Url is larger than %d bytes",
+			f.MaxSize,
+		)
+	}
+
+	fetchBytes.Observe(float64(len(data)))
+	if contentType := http.DetectContentType(data); !m.accepts(contentType) {
+		return nil, newFetchError(
+			http.StatusUnsupportedMediaType,
+			m.Code,
+			"Unsupported content type %s",
+			contentType,
+		)
+	}
+
+	return data, nil
+}
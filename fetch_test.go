@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// upstream serves the responses the fetcher has to handle
+func upstream(t *testing.T) *httptest.Server {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img.Bytes())
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/sniffed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/streamed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for i := 0; i < 4; i++ {
+			w.Write(make([]byte, 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func testFetcher() *fetcher {
+	return &fetcher{
+		Schemes:      []string{"http"},
+		AllowPrivate: true,
+		MaxRedirects: 2,
+		Timeout:      time.Millisecond * 200,
+		MaxSize:      1024,
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := upstream(t)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/image", 0, ""},
+		{"/missing", http.StatusFailedDependency, "upstream_status"},
+		{"/broken", http.StatusFailedDependency, "upstream_status"},
+		{"/slow", http.StatusGatewayTimeout, "upstream_timeout"},
+		{"/html", http.StatusUnsupportedMediaType, "not_an_image"},
+		{"/sniffed", http.StatusUnsupportedMediaType, "not_an_image"},
+		{"/large", http.StatusRequestEntityTooLarge, "file_too_large"},
+		{"/streamed", http.StatusRequestEntityTooLarge, "file_too_large"},
+		{"/loop", http.StatusBadGateway, "too_many_redirects"},
+	}
+
+	f := testFetcher()
+	for _, test := range tests {
+		_, err := f.fetch(context.Background(), srv.URL+test.path, imageMedia)
+		if test.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.path, err)
+			}
+
+			continue
+		}
+
+		ferr, ok := err.(*fetchError)
+		if !ok {
+			t.Errorf("%s: got %v, want a fetch error", test.path, err)
+			continue
+		}
+
+		if ferr.status != test.status || ferr.code != test.code {
+			t.Errorf("%s: got %d %s, want %d %s", test.path, ferr.status, ferr.code, test.status, test.code)
+		}
+	}
+}
+
+func TestFetchConcurrent(t *testing.T) {
+	srv := upstream(t)
+	defer srv.Close()
+
+	f := testFetcher()
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			_, err := f.fetch(context.Background(), srv.URL+"/image", imageMedia)
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFetchPrivateAddress(t *testing.T) {
+	srv := upstream(t)
+	defer srv.Close()
+
+	f := testFetcher()
+	f.AllowPrivate = false
+	_, err := f.fetch(context.Background(), srv.URL+"/image", imageMedia)
+	ferr, ok := err.(*fetchError)
+	if !ok || ferr.status != http.StatusForbidden || ferr.code != "private_address" {
+		t.Errorf("Got %v, want 403 private_address", err)
+	}
+}
+
+func TestFetchURL(t *testing.T) {
+	f := testFetcher()
+	f.DenyHosts = []string{"*.example.com"}
+	tests := []struct {
+		url    string
+		status int
+		code   string
+	}{
+		{"ftp://example.org/image", http.StatusBadRequest, "scheme_not_allowed"},
+		{"http:///image", http.StatusBadRequest, "invalid_url"},
+		{"http://images.example.com/image", http.StatusForbidden, "host_not_allowed"},
+	}
+
+	for _, test := range tests {
+		_, err := f.fetch(context.Background(), test.url, imageMedia)
+		ferr, ok := err.(*fetchError)
+		if !ok || ferr.status != test.status || ferr.code != test.code {
+			t.Errorf("%s: got %v, want %d %s", test.url, err, test.status, test.code)
+		}
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	srv := upstream(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+	_, err := testFetcher().fetch(ctx, srv.URL+"/slow", imageMedia)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want the error of the context", err)
+	}
+
+	if d := time.Since(start); d > time.Millisecond*150 {
+		t.Errorf("Fetch stopped after %s, not at the deadline of the context", d)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,33 +12,49 @@ import (
 	"strings"
 
 	"github.com/wieni/go-imgrect/canny"
+	"github.com/wieni/go-imgrect/imgrect"
 	"github.com/wieni/go-tls/simplehttp"
 )
 
 type response struct {
-	Msg interface{} `json:"msg"`
+	Msg   interface{}   `json:"msg,omitempty"`
+	Error *requestError `json:"error,omitempty"`
 }
 
-func router(r *http.Request, l *log.Logger) (simplehttp.HandleFunc, int) {
-	switch r.Method {
-	case "OPTION":
-		return serveOption, 0
-	case "POST":
-		fallthrough
-	case "GET":
-		switch strings.Trim(r.URL.Path, " /") {
-		case "":
-			return serveHelp, 0
-		case "weighted":
-			return serveRects, 0
-		case "bounded":
-			return serveBounded, 0
+// route returns the name and handler of a path, fn is nil for unknown paths
+func route(path string) (name string, fn simplehttp.HandleFunc) {
+	switch strings.Trim(path, " /") {
+	case "":
+		return "help", serveHelp
+	case "weighted":
+		return "weighted", serveRects
+	case "bounded":
+		return "bounded", serveBounded
+	case "batch":
+		return "batch", serveBatch
+	case "metrics":
+		return "metrics", serveMetrics
+	case "config":
+		if cfg.Debug {
+			return "config", serveConfig
 		}
-	default:
-		return nil, http.StatusMethodNotAllowed
 	}
 
-	return nil, 0
+	return "", nil
+}
+
+func router(r *http.Request, l *log.Logger) (simplehttp.HandleFunc, int) {
+	name, fn := route(r.URL.Path)
+	switch {
+	case fn == nil:
+		return instrument("unknown", serveError(http.StatusNotFound, "not_found")), 0
+	case r.Method == "OPTIONS":
+		return instrument(name, servePreflight), 0
+	case r.Method != "GET" && r.Method != "POST":
+		return instrument(name, serveError(http.StatusMethodNotAllowed, "method_not_allowed")), 0
+	}
+
+	return instrument(name, fn), 0
 }
 
 func serveHelp(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
@@ -46,80 +63,154 @@ func serveHelp(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus
 	return
 }
 
-func serveOption(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
-	return
+// serveError answers with an error without a field
+func serveError(status int, code string) simplehttp.HandleFunc {
+	return func(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
+		return writeError(w, status, &requestError{code, "", http.StatusText(status)})
+	}
 }
 
-func serveBounded(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, herr error) {
-	maxFormSize := int64(60 << 20)
-	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+func serveBounded(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxFormSize)
 	defer r.Body.Close()
 	w.Header().Set("Content-Type", "application/json")
 
-	i := 0
-	rects := make([]*percentRectangle, 0, 2)
+	var rects []*imgrect.PercentRectangle
+	var source *fileSource
 
-	for {
-		rect, err := getBound(r, i)
-		if err != nil {
-			break
+	if isJSONRequest(r) {
+		req := &boundedRequest{}
+		rerr := decodeJSONRequest(r, req)
+		if rerr == nil {
+			rerr = req.validate()
+		}
+
+		if rerr != nil {
+			return rejectRequest(w, rerr)
+		}
+
+		rects = req.rects()
+		source = req.Image
+	} else {
+		if rerr := parseForm(r); rerr != nil {
+			return rejectRequest(w, rerr)
 		}
 
-		rects = append(rects, rect)
-		i++
-		if i > 20 {
-			errStatus = http.StatusNotAcceptable
-			return
+		rects = make([]*imgrect.PercentRectangle, 0, 2)
+		for i := 0; ; i++ {
+			rect, rerr := getBound(r, i)
+			if rerr != nil {
+				return rejectRequest(w, rerr)
+			}
+
+			if rect == nil {
+				break
+			}
+
+			if i >= cfg.MaxBounds {
+				return writeError(w, http.StatusNotAcceptable, &requestError{
+					"too_many_bounds",
+					fmt.Sprintf("b%d", i),
+					fmt.Sprintf("At most %d bounds are allowed", cfg.MaxBounds),
+				})
+			}
+
+			rects = append(rects, rect)
+		}
+
+		if len(rects) < 2 {
+			return writeError(w, http.StatusNotAcceptable, &requestError{
+				"too_few_bounds",
+				fmt.Sprintf("b%d", len(rects)),
+				"At least 2 bounds are required",
+			})
+		}
+
+		var rerr *requestError
+		source, rerr = getRequestSource(r, "file", "url")
+		if rerr != nil {
+			return rejectRequest(w, rerr)
 		}
 	}
 
-	if len(rects) < 2 {
-		errStatus = http.StatusNotAcceptable
-		return
+	getRequestLog(r.Context()).setRequest(source, rects)
+	ctx, cancel := processContext(r.Context())
+	defer cancel()
+
+	key, err := cacheKey(ctx, "bounded", rects, source)
+	if err != nil {
+		return writeHandlerError(w, sourceError("image", err))
 	}
 
-	file, err := getRequestFile(r, "file", "url")
+	return serveCached(w, r, key, fetched(source), func() (interface{}, *handlerError) {
+		return runBounded(ctx, source, rects)
+	})
+}
+
+// runBounded scores the rects of the image in source
+func runBounded(
+	ctx context.Context,
+	source *fileSource,
+	rects []*imgrect.PercentRectangle,
+) (imgrect.Bounds, *handlerError) {
+	file, err := source.open(ctx)
 	if err != nil {
-		errStatus = http.StatusNotAcceptable
-		herr = err
-		return
+		return nil, sourceError("image", err)
 	}
 	defer file.Close()
 
-	bounds, err := bounded(file, rects)
+	stats := &imgrect.Stats{}
+	bounds, err := imgrect.Bounded(ctx, file, imgrect.BoundedOptions{
+		Bounds:       rects,
+		MaxImageSize: cfg.MaxImageSize,
+		Stats:        stats,
+	})
+	observeStats(stats)
+	if err == canny.ErrLoadFailed {
+		return nil, &handlerError{http.StatusUnsupportedMediaType, &requestError{"not_an_image", "image", err.Error()}, err}
+	}
+
 	if err == canny.ErrInvalidBounds {
-		errStatus = http.StatusNotAcceptable
-		return
+		return nil, &handlerError{http.StatusNotAcceptable, &requestError{"invalid_bounds", "bounds", err.Error()}, err}
+	}
+
+	if herr := contextError(err); herr != nil {
+		return nil, herr
 	}
 
 	if err != nil {
-		herr = err
-		return
+		return nil, &handlerError{err: err}
 	}
 
-	return 0, json.NewEncoder(w).Encode(&response{bounds})
+	getRequestLog(ctx).setResult(stats.Width, stats.Height, len(bounds))
+	return bounds, nil
 }
 
 func serveRects(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
-	maxFormSize := int64(60 << 20)
-	r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxFormSize)
 	defer r.Body.Close()
 
-	var file io.ReadCloser
-	file, err = getRequestFile(r, "file", "url")
-	if err != nil {
-		errStatus = http.StatusNotAcceptable
-		return
-	}
-	defer file.Close()
+	var req *weightedRequest
+	if isJSONRequest(r) {
+		req = &weightedRequest{}
+		if rerr := decodeJSONRequest(r, req); rerr != nil {
+			return rejectRequest(w, rerr)
+		}
+	} else {
+		rerr := parseForm(r)
+		if rerr == nil {
+			req, rerr = getWeightedRequest(r)
+		}
 
-	font, _ := getRequestFile(r, "font", "fonturl")
-	if font != nil {
-		defer font.Close()
+		if rerr != nil {
+			return rejectRequest(w, rerr)
+		}
 	}
 
-	width := getFormFloat(r, "w", 1)
-	height := getFormFloat(r, "h", 1)
+	getRequestLog(r.Context()).setRequest(req.Image, req.params())
+	if rerr := req.validate(); rerr != nil {
+		return rejectRequest(w, rerr)
+	}
 
 	var preview io.Writer
 	if r.URL.Query().Get("preview") != "" {
@@ -132,102 +223,520 @@ func serveRects(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatu
 		headers.Set("Content-Type", "image/jpeg")
 	}
 
-	fontSize := getFormFloat(r, "fontsize", 0)
-	fontText := r.FormValue("text")
+	ctx, cancel := processContext(r.Context())
+	defer cancel()
+
+	if preview != nil {
+		_, hErr := runWeighted(ctx, req, preview)
+		if hErr != nil {
+			return writeHandlerError(w, hErr)
+		}
+
+		return
+	}
+
+	key, herr := req.cacheKey(ctx)
+	if herr != nil {
+		return writeHandlerError(w, herr)
+	}
+
+	return serveCached(w, r, key, fetched(req.Image, req.Font, req.Mask), func() (interface{}, *handlerError) {
+		return runWeighted(ctx, req, nil)
+	})
+}
+
+// runWeighted finds the rectangles of a validated request. The returned
+// message is nil when a preview is written.
+func runWeighted(ctx context.Context, req *weightedRequest, preview io.Writer) (interface{}, *handlerError) {
+	file, err := req.Image.open(ctx)
+	if err != nil {
+		return nil, sourceError("image", err)
+	}
+	defer file.Close()
 
-	var region [4]int
+	var mask io.Reader
+	if req.Mask != nil {
+		m, err := req.Mask.open(ctx)
+		if err != nil {
+			return nil, sourceError("mask", err)
+		}
+		defer m.Close()
+		mask = m
+	}
 
-	region[0] = getFormInt(r, "pt", 0)
-	region[1] = getFormInt(r, "pr", 0)
-	region[2] = getFormInt(r, "pb", 0)
-	region[3] = getFormInt(r, "pl", 0)
+	var font io.Reader
+	if req.Font != nil {
+		f, err := req.font().open(ctx)
+		if err != nil {
+			return nil, sourceError("font", err)
+		}
+		defer f.Close()
+		font = f
+	}
 
-	var re []*percentRectangle
-	re, err = weighted(file, font, fontSize, fontText, 5, width, height, region, preview)
+	minAspect, maxAspect := req.aspects()
+	stats := &imgrect.Stats{}
+	result, err := imgrect.Weighted(ctx, file, imgrect.WeightedOptions{
+		Amount:      req.amount(),
+		MinAmount:   req.Min,
+		MinWidth:    req.Width,
+		MinHeight:   req.Height,
+		MinAspect:   minAspect,
+		MaxAspect:   maxAspect,
+		Padding:     req.Padding,
+		Regions:     req.regions(),
+		KeepOut:     percentRectangles(req.KeepOut),
+		Mask:        mask,
+		Detector:    req.detector(),
+		Composition: req.Composition,
+		Gravity:     req.Gravity,
+		Snap:        req.Snap,
+		Text:        req.text(font),
+		Preview:     preview,
+		Faces:       req.Faces,
+		FaceCascade: faceCascade,
+		Stats:       stats,
+
+		MaxImageSize:     cfg.MaxImageSize,
+		SoftMaxThreshold: cfg.SoftMaxThreshold,
+		MaxThreshold:     cfg.MaxThreshold,
+	})
+	observeStats(stats)
 	if err == canny.ErrLoadFailed {
-		errStatus = http.StatusUnsupportedMediaType
-		return
+		return nil, &handlerError{http.StatusUnsupportedMediaType, &requestError{"not_an_image", "image", err.Error()}, err}
 	}
 
-	if err != nil || preview != nil {
-		return
+	if err == imgrect.ErrMaskLoadFailed {
+		return nil, &handlerError{http.StatusUnsupportedMediaType, &requestError{"not_an_image", "mask", err.Error()}, err}
+	}
+
+	if err == imgrect.ErrFontLoadFailed {
+		return nil, &handlerError{http.StatusUnsupportedMediaType, &requestError{"not_a_font", "font", err.Error()}, err}
+	}
+
+	if err == imgrect.ErrTooManyLines {
+		return nil, &handlerError{http.StatusNotAcceptable, &requestError{"too_many_lines", "maxlines", err.Error()}, err}
+	}
+
+	if err == imgrect.ErrTextDoesNotFit {
+		return nil, &handlerError{http.StatusUnprocessableEntity, &requestError{"text_does_not_fit", "minfontsize", err.Error()}, err}
+	}
+
+	if err == imgrect.ErrNoCascade {
+		return nil, &handlerError{http.StatusNotImplemented, &requestError{"faces_unsupported", "faces", err.Error()}, err}
+	}
+
+	if ierr, ok := err.(*imgrect.InsufficientError); ok {
+		field := "min"
+		if ierr.Region >= 0 {
+			field = fmt.Sprintf("regions[%d]", ierr.Region)
+		}
+
+		return nil, &handlerError{http.StatusUnprocessableEntity, &requestError{"insufficient_rects", field, ierr.Error()}, err}
+	}
+
+	if err == canny.ErrInvalidBounds {
+		return nil, &handlerError{http.StatusNotAcceptable, &requestError{"invalid_bounds", "regions", err.Error()}, err}
+	}
+
+	if herr := contextError(err); herr != nil {
+		return nil, herr
+	}
+
+	if err != nil {
+		return nil, &handlerError{err: err}
+	}
+
+	rectsFound.Observe(float64(len(result.Rects)))
+	getRequestLog(ctx).setResult(stats.Width, stats.Height, len(result.Rects))
+	if preview != nil {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// getWeightedRequest reads the /weighted parameters from the query string
+// or form
+func getWeightedRequest(r *http.Request) (*weightedRequest, *requestError) {
+	file, err := getRequestSource(r, "file", "url")
+	if err != nil {
+		return nil, err
+	}
+
+	font, err := getOptionalSource(r, "font", "fonturl")
+	if err != nil {
+		return nil, err
+	}
+
+	mask, err := getOptionalSource(r, "mask", "maskurl")
+	if err != nil {
+		return nil, err
+	}
+
+	keepOut, err := getKeepOut(r)
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := getRegions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	form := &formReader{r: r}
+	req := &weightedRequest{
+		Image:       file,
+		Width:       form.float("w", 1),
+		Height:      form.float("h", 1),
+		MinAspect:   form.float("minaspect", 0),
+		MaxAspect:   form.float("maxaspect", 0),
+		Aspect:      form.float("aspect", 0),
+		Regions:     regions,
+		KeepOut:     keepOut,
+		Mask:        mask,
+		Font:        font,
+		FontSize:    form.float("fontsize", 0),
+		Fit:         form.bool("fit"),
+		MinFontSize: form.float("minfontsize", 0),
+		MaxFontSize: form.float("maxfontsize", 0),
+		Text:        r.FormValue("text"),
+		MaxLines:    form.int("maxlines", 0),
+		LineHeight:  form.float("lineheight", 0),
+		Align:       r.FormValue("align"),
+		N:           form.int("n", 0),
+		Min:         form.int("min", 0),
+		Detector:    r.FormValue("detector"),
+		Composition: r.FormValue("composition"),
+		Gravity:     r.FormValue("gravity"),
+		Snap:        form.float("snap", 0),
+		Faces:       r.FormValue("faces"),
+		Padding: imgrect.Padding{
+			Top:    form.int("pt", 0),
+			Right:  form.int("pr", 0),
+			Bottom: form.int("pb", 0),
+			Left:   form.int("pl", 0),
+		},
+	}
+
+	if form.err != nil {
+		return nil, form.err
 	}
 
-	return 0, json.NewEncoder(w).Encode(&response{re})
+	return req, nil
 }
 
-func getRequestFile(r *http.Request, fileField, urlField string) (file io.ReadCloser, err error) {
+// getRequestSource returns the uploaded file in fileField or,
+// if there is none, the url in urlField
+func getRequestSource(r *http.Request, fileField, urlField string) (*fileSource, *requestError) {
 	if r.Method == "POST" {
-		file, _, err = r.FormFile(fileField)
+		file, _, err := r.FormFile(fileField)
 		if err == nil {
-			return
+			return &fileSource{upload: file}, nil
 		}
-	}
 
-	if r.Method == "GET" || err == http.ErrMissingFile {
-		url := r.FormValue(urlField)
-		if url == "" {
-			err = errors.New("No url")
-			return
+		if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+			return nil, bodyError(fileField, err)
 		}
+	}
 
-		var resp *http.Response
-		resp, err = http.Get(url)
-		if err != nil {
-			return
+	url := r.FormValue(urlField)
+	if url == "" {
+		return nil, &requestError{"required", urlField, fmt.Sprintf("Either %s or %s is required", fileField, urlField)}
+	}
+
+	return &fileSource{URL: url}, nil
+}
+
+// parseForm parses the query string and the url encoded or multipart form
+// in the body of r
+func parseForm(r *http.Request) *requestError {
+	err := r.ParseForm()
+	if err == nil {
+		err = r.ParseMultipartForm(cfg.MaxFormSize)
+	}
+
+	if err != nil && err != http.ErrNotMultipart {
+		return bodyError("", err)
+	}
+
+	return nil
+}
+
+// bodyError reports a request body that could not be read, bodies larger
+// than -maxformsize are reported as body_too_large
+func bodyError(field string, err error) *requestError {
+	var merr *http.MaxBytesError
+	if errors.As(err, &merr) {
+		return &requestError{"body_too_large", "", fmt.Sprintf("Body is larger than %d bytes", merr.Limit)}
+	}
+
+	return &requestError{"invalid_body", field, err.Error()}
+}
+
+// getOptionalSource is like getRequestSource, it returns nil when neither
+// fileField nor urlField is given
+func getOptionalSource(r *http.Request, fileField, urlField string) (*fileSource, *requestError) {
+	source, err := getRequestSource(r, fileField, urlField)
+	if err != nil && err.Code == "required" {
+		return nil, nil
+	}
+
+	return source, err
+}
+
+// sourceError reports a file in field that could not be opened
+func sourceError(field string, err error) *handlerError {
+	if herr := contextError(err); herr != nil {
+		return herr
+	}
+
+	if ferr, ok := err.(*fetchError); ok {
+		return &handlerError{ferr.status, &requestError{ferr.code, field, ferr.msg}, err}
+	}
+
+	return &handlerError{http.StatusNotAcceptable, &requestError{"unreadable_file", field, err.Error()}, err}
+}
+
+// processContext limits the processing of a request to the -timeout flag
+func processContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.ProcessTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, cfg.ProcessTimeout)
+}
+
+// contextError reports processing that was stopped by its context, nil
+// for other errors
+func contextError(err error) *handlerError {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &handlerError{
+			http.StatusServiceUnavailable,
+			&requestError{"deadline_exceeded", "", fmt.Sprintf("Processing took longer than %s", cfg.ProcessTimeout)},
+			err,
+		}
+	case errors.Is(err, context.Canceled):
+		return &handlerError{
+			http.StatusServiceUnavailable,
+			&requestError{"canceled", "", "Processing was canceled"},
+			err,
 		}
+	}
 
-		file = resp.Body
+	return nil
+}
+
+// handlerError is an error and the status it is reported with. Errors
+// without a body are unexpected and reported as internal errors.
+type handlerError struct {
+	status int
+	body   *requestError
+	err    error
+}
+
+// requestError returns the body of the error or, if there is none, creates
+// one from its message
+func (e *handlerError) requestError() *requestError {
+	if e.body != nil {
+		return e.body
 	}
 
-	return
+	if e.err != nil {
+		return &requestError{Code: "internal_error", Message: e.err.Error()}
+	}
+
+	return &requestError{Code: "internal_error", Message: http.StatusText(e.status)}
 }
 
-func getFormFloat(r *http.Request, key string, fallback float64) float64 {
-	val := r.FormValue(key)
-	intVal, err := strconv.ParseFloat(val, 64)
+// rejectRequest answers with the error of a request that can not be
+// processed, with 413 for bodies that are too large and 406 otherwise
+func rejectRequest(w http.ResponseWriter, rerr *requestError) (int, error) {
+	if rerr.Code == "body_too_large" {
+		return writeError(w, http.StatusRequestEntityTooLarge, rerr)
+	}
+
+	return writeError(w, http.StatusNotAcceptable, rerr)
+}
+
+func writeHandlerError(w http.ResponseWriter, herr *handlerError) (int, error) {
+	status := herr.status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+
+	return writeError(w, status, herr.requestError())
+}
+
+func writeError(w http.ResponseWriter, status int, rerr *requestError) (int, error) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.code = rerr.Code
+		sw.message = rerr.Message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return 0, json.NewEncoder(w).Encode(&response{Error: rerr})
+}
+
+// formReader parses typed form values, it keeps the first value that does
+// not parse in err
+type formReader struct {
+	r   *http.Request
+	err *requestError
+}
+
+// value returns the value of key, ok is false when it is missing
+func (f *formReader) value(key string) (string, bool) {
+	val := f.r.FormValue(key)
+	return val, val != ""
+}
+
+func (f *formReader) fail(key, expected string) {
+	if f.err == nil {
+		f.err = &requestError{"invalid_type", key, "Expected " + expected}
+	}
+}
+
+func (f *formReader) float(key string, fallback float64) float64 {
+	val, ok := f.value(key)
+	if !ok {
+		return fallback
+	}
+
+	floatVal, err := strconv.ParseFloat(val, 64)
 	if err != nil {
-		intVal = fallback
+		f.fail(key, "a number")
+		return fallback
 	}
 
-	return intVal
+	return floatVal
+}
+
+func (f *formReader) bool(key string) bool {
+	val, ok := f.value(key)
+	if !ok {
+		return false
+	}
+
+	boolVal, err := strconv.ParseBool(val)
+	if err != nil {
+		f.fail(key, "a boolean")
+	}
+
+	return boolVal
 }
 
-func getFormInt(r *http.Request, key string, fallback int) int {
-	val := r.FormValue(key)
+func (f *formReader) int(key string, fallback int) int {
+	val, ok := f.value(key)
+	if !ok {
+		return fallback
+	}
+
 	intVal, err := strconv.Atoi(val)
 	if err != nil {
-		intVal = fallback
+		f.fail(key, "an integer")
+		return fallback
 	}
 
 	return intVal
 }
 
-func getBound(r *http.Request, index int) (*percentRectangle, error) {
-	raw := strings.Split(r.FormValue(fmt.Sprintf("b%d", index)), ",")
+// boundComponents names the values of a bound
+var boundComponents = [4]string{"x1", "y1", "x2", "y2"}
+
+// getBound parses the bN parameter, it returns nil when there is none
+func getBound(r *http.Request, index int) (*imgrect.PercentRectangle, *requestError) {
+	field := fmt.Sprintf("b%d", index)
+	spec := r.FormValue(field)
+	if spec == "" {
+		return nil, nil
+	}
+
+	return parseBound(field, spec)
+}
+
+// parseBound parses a x1,y1,x2,y2 spec, errors are reported on field
+func parseBound(field, spec string) (*imgrect.PercentRectangle, *requestError) {
+	values, err := parseRect(field, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return imgrect.NewPercentRectangle(values[0], values[1], values[2], values[3]), nil
+}
+
+// getKeepOut parses the kN parameters of /weighted
+func getKeepOut(r *http.Request) ([][]float64, *requestError) {
+	var rects [][]float64
+	for i := 0; ; i++ {
+		field := fmt.Sprintf("k%d", i)
+		spec := r.FormValue(field)
+		if spec == "" {
+			return rects, nil
+		}
+
+		values, err := parseRect(field, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		rects = append(rects, values)
+	}
+}
+
+// getRegions parses the rN, rN.w, rN.h and rN.n parameters of /weighted
+func getRegions(r *http.Request) ([]*searchRegion, *requestError) {
+	var regions []*searchRegion
+	for i := 0; ; i++ {
+		field := fmt.Sprintf("r%d", i)
+		spec := r.FormValue(field)
+		if spec == "" {
+			return regions, nil
+		}
+
+		bounds, err := parseRect(field, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		form := &formReader{r: r}
+		regions = append(regions, &searchRegion{
+			Bounds: bounds,
+			Width:  form.float(field+".w", 0),
+			Height: form.float(field+".h", 0),
+			N:      form.int(field+".n", 0),
+		})
+
+		if form.err != nil {
+			return nil, form.err
+		}
+	}
+}
+
+// parseRect parses the values of a x1,y1,x2,y2 spec, errors are reported
+// on field
+func parseRect(field, spec string) ([]float64, *requestError) {
+	raw := strings.Split(spec, ",")
 	if len(raw) != 4 {
-		return nil, errors.New("Invalid rectangle spec")
+		return nil, &requestError{"invalid_bound", field, "Expected x1,y1,x2,y2"}
 	}
 
-	var ints [4]int
-	var values [4]float64
+	values := make([]float64, 4)
 	for i := range raw {
-		val, err := strconv.ParseFloat(raw[i], 64)
-		//integ, err := strconv.Atoi(raw[i])
+		component := field + "." + boundComponents[i]
+		val, err := strconv.ParseFloat(strings.TrimSpace(raw[i]), 64)
 		if err != nil {
-			return nil, err
+			return nil, &requestError{"invalid_bound", component, fmt.Sprintf("Expected a number, got %q", raw[i])}
 		}
 
-		if val < 1 {
-			values[i] = val
-			continue
+		if val < 0 {
+			return nil, &requestError{"invalid_bound", component, "Must not be negative"}
 		}
 
-		ints[i] = int(val)
+		values[i] = val
 	}
 
-	return &percentRectangle{
-		Min: &percentPoint{ints[0], ints[1], values[0], values[1]},
-		Max: &percentPoint{ints[2], ints[3], values[2], values[3]},
-	}, nil
+	return values, nil
 }
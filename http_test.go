@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFormTypes(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"w=abc", "w"},
+		{"n=x", "n"},
+		{"n=1.5", "n"},
+		{"fit=maybe", "fit"},
+		{"r0=0,0,50,50&r0.w=wide", "r0.w"},
+	}
+
+	for _, test := range tests {
+		target := "/weighted?url=" + url.QueryEscape("http://example.com/image.png") + "&" + test.query
+		w := serve(httptest.NewRequest("GET", target, nil))
+		checkError(t, w, http.StatusNotAcceptable, "invalid_type")
+		if !strings.Contains(w.Body.String(), `"field":"`+test.field+`"`) {
+			t.Errorf("%s: body %s, want field %s", test.query, w.Body.String(), test.field)
+		}
+
+		// The same values in a form body
+		r := httptest.NewRequest("POST", "/weighted", strings.NewReader("url=http://example.com/image.png&"+test.query))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		checkError(t, serve(r), http.StatusNotAcceptable, "invalid_type")
+	}
+}
@@ -0,0 +1,124 @@
+package imgrect
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// WCAG 2 contrast ratios for normal text
+const (
+	contrastAA  = 4.5
+	contrastAAA = 7
+)
+
+// ColorAdvice describes the colors of a rectangle and the text color that
+// is most readable on it
+type ColorAdvice struct {
+	// Luminance is the mean relative luminance, from 0 (black) to 1 (white)
+	Luminance  float64 `json:"luminance"`
+	Dominant   string  `json:"dominant"`
+	Foreground string  `json:"foreground"`
+	Contrast   float64 `json:"contrast"`
+	// Level is the WCAG level the foreground meets: AAA, AA or empty
+	Level string `json:"level"`
+
+	foreground color.Color
+}
+
+// relativeLuminance as defined by WCAG 2
+func relativeLuminance(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	linear := func(v uint32) float64 {
+		s := float64(v) / 0xffff
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+
+	return 0.2126*linear(r) + 0.7152*linear(g) + 0.0722*linear(b)
+}
+
+// contrastRatio between two relative luminances
+func contrastRatio(l1, l2 float64) float64 {
+	return (math.Max(l1, l2) + 0.05) / (math.Min(l1, l2) + 0.05)
+}
+
+func hexColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// adviseColor analyzes the colors of img within rect
+func adviseColor(img image.Image, rect image.Rectangle) *ColorAdvice {
+	rect = rect.Intersect(img.Bounds())
+	if rect.Empty() {
+		return nil
+	}
+
+	// Colors are grouped in buckets of 4 bits per channel
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	var dominant *bucket
+	var luminance float64
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := img.At(x, y)
+			luminance += relativeLuminance(c)
+
+			r, g, b, _ := c.RGBA()
+			key := int(r>>12)<<8 | int(g>>12)<<4 | int(b>>12)
+			bu, ok := buckets[key]
+			if !ok {
+				bu = &bucket{}
+				buckets[key] = bu
+			}
+
+			bu.r += int(r >> 8)
+			bu.g += int(g >> 8)
+			bu.b += int(b >> 8)
+			bu.n++
+			if dominant == nil || bu.n > dominant.n {
+				dominant = bu
+			}
+		}
+	}
+
+	advice := &ColorAdvice{
+		Luminance: luminance / float64(rect.Dx()*rect.Dy()),
+	}
+
+	advice.Dominant = hexColor(color.RGBA{
+		uint8(dominant.r / dominant.n),
+		uint8(dominant.g / dominant.n),
+		uint8(dominant.b / dominant.n),
+		255,
+	})
+
+	// The best of black and white always meets AA
+	white := contrastRatio(1, advice.Luminance)
+	black := contrastRatio(0, advice.Luminance)
+	advice.foreground = color.White
+	advice.Contrast = white
+	if black > white {
+		advice.foreground = color.Black
+		advice.Contrast = black
+	}
+
+	advice.Foreground = hexColor(advice.foreground)
+	advice.Contrast = math.Round(advice.Contrast*100) / 100
+	switch {
+	case advice.Contrast >= contrastAAA:
+		advice.Level = "AAA"
+	case advice.Contrast >= contrastAA:
+		advice.Level = "AA"
+	}
+
+	return advice
+}
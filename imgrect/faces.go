@@ -0,0 +1,88 @@
+package imgrect
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"sort"
+	"sync"
+
+	"github.com/wieni/go-imgrect/asset"
+	"github.com/wieni/go-imgrect/canny"
+)
+
+const (
+	// FacesDrop drops rectangles that overlap a face
+	FacesDrop = "drop"
+	// FacesPenalize lowers the score of rectangles by the part of them
+	// covered by faces
+	FacesPenalize = "penalize"
+
+	// cascadeAsset is the frontal face cascade of opencv, it is checked in
+	// under asset/assets
+	cascadeAsset = "assets/haarcascade_frontalface_alt.xml"
+)
+
+// ErrNoCascade is returned when faces are requested without a cascade and
+// none was bundled
+var ErrNoCascade = errors.New("No face cascade was bundled, set one with -facecascade")
+
+var (
+	defaultCascade     *canny.Cascade
+	defaultCascadeErr  error
+	defaultCascadeOnce sync.Once
+)
+
+// DefaultCascade returns the bundled frontal face cascade, it is only
+// parsed once
+func DefaultCascade() (*canny.Cascade, error) {
+	defaultCascadeOnce.Do(func() {
+		raw, err := asset.Asset(cascadeAsset)
+		if err != nil {
+			defaultCascadeErr = ErrNoCascade
+			return
+		}
+
+		defaultCascade, defaultCascadeErr = canny.ParseCascade(bytes.NewReader(raw))
+	})
+
+	return defaultCascade, defaultCascadeErr
+}
+
+// faceOverlap returns the area of r covered by faces
+func faceOverlap(r *image.Rectangle, faces canny.Rectangles) int {
+	covered := 0
+	for _, face := range faces {
+		overlap := r.Intersect(*face)
+		covered += overlap.Dx() * overlap.Dy()
+	}
+
+	return covered
+}
+
+// dropFaces removes the rectangles that overlap any of faces
+func dropFaces(rects, faces canny.Rectangles) canny.Rectangles {
+	kept := rects[:0]
+	for _, r := range rects {
+		if faceOverlap(r, faces) == 0 {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept
+}
+
+// penalizeFaces lowers the total score of each rectangle by the part of it
+// covered by faces and sorts them by their new score
+func penalizeFaces(rects canny.Rectangles, scores []*PlacementScore, faces canny.Rectangles) {
+	for i, r := range rects {
+		covered := float64(faceOverlap(r, faces)) / float64(r.Dx()*r.Dy())
+		if covered > 1 {
+			covered = 1
+		}
+
+		scores[i].Total *= 1 - covered
+	}
+
+	sort.Stable(scoredRects{rects, scores})
+}
@@ -0,0 +1,105 @@
+package imgrect
+
+import (
+	"image"
+	"math"
+
+	"github.com/wieni/go-imgrect/canny"
+)
+
+// anchor is a point of a rectangle in fractions of its width and height
+type anchor struct {
+	x float64
+	y float64
+}
+
+// gravities maps the names of the Gravity option to their anchor
+var gravities = map[string]anchor{
+	"n":      {0.5, 0},
+	"ne":     {1, 0},
+	"e":      {1, 0.5},
+	"se":     {1, 1},
+	"s":      {0.5, 1},
+	"sw":     {0, 1},
+	"w":      {0, 0.5},
+	"nw":     {0, 0},
+	"center": {0.5, 0.5},
+}
+
+// GravityNames returns the values of the Gravity option
+func GravityNames() []string {
+	return []string{"n", "ne", "e", "se", "s", "sw", "w", "nw", "center"}
+}
+
+// IsGravity reports whether name is a value of the Gravity option
+func IsGravity(name string) bool {
+	_, ok := gravities[name]
+	return ok
+}
+
+// gravityScore rates how close the anchor of r is to the anchor of a w x h
+// image, 1 when they coincide
+func gravityScore(a anchor, r *image.Rectangle, w, h float64) float64 {
+	dx := float64(r.Min.X) + a.x*float64(r.Dx()) - a.x*w
+	dy := float64(r.Min.Y) + a.y*float64(r.Dy()) - a.y*h
+	return 1 - math.Hypot(dx, dy)/math.Hypot(w, h)
+}
+
+// snap moves the edges of r on the side of anchor a to the border of
+// bounds when they are within tolX and tolY of it. Edges are only moved
+// when free reports the area they add is free.
+func snap(r *image.Rectangle, a anchor, tolX, tolY int, bounds image.Rectangle, free func(image.Rectangle) bool) {
+	var added image.Rectangle
+	switch {
+	case a.x == 0 && r.Min.X > bounds.Min.X && r.Min.X-bounds.Min.X <= tolX:
+		added = image.Rect(bounds.Min.X, r.Min.Y, r.Min.X, r.Max.Y)
+	case a.x == 1 && r.Max.X < bounds.Max.X && bounds.Max.X-r.Max.X <= tolX:
+		added = image.Rect(r.Max.X, r.Min.Y, bounds.Max.X, r.Max.Y)
+	}
+
+	if !added.Empty() && free(added) {
+		*r = r.Union(added)
+	}
+
+	added = image.Rectangle{}
+	switch {
+	case a.y == 0 && r.Min.Y > bounds.Min.Y && r.Min.Y-bounds.Min.Y <= tolY:
+		added = image.Rect(r.Min.X, bounds.Min.Y, r.Max.X, r.Min.Y)
+	case a.y == 1 && r.Max.Y < bounds.Max.Y && bounds.Max.Y-r.Max.Y <= tolY:
+		added = image.Rect(r.Min.X, r.Max.Y, r.Max.X, bounds.Max.Y)
+	}
+
+	if !added.Empty() && free(added) {
+		*r = r.Union(added)
+	}
+}
+
+// keepAspect shrinks r to the largest rectangle of which the width / height
+// ratio lies between minAspect and maxAspect, a bound of 0 is not checked.
+// The anchor a of r stays in place, so edges snapped to a border stay on it.
+func keepAspect(r *image.Rectangle, a anchor, minAspect, maxAspect float64) {
+	w := r.Dx()
+	h := r.Dy()
+	switch {
+	case maxAspect > 0 && float64(w) > float64(h)*maxAspect:
+		w = int(math.Round(float64(h) * maxAspect))
+	case minAspect > 0 && float64(w) < float64(h)*minAspect:
+		h = int(math.Round(float64(w) / minAspect))
+	}
+
+	x := r.Min.X + int(a.x*float64(r.Dx()-w))
+	y := r.Min.Y + int(a.y*float64(r.Dy()-h))
+	*r = image.Rect(x, y, x+w, y+h)
+}
+
+// overlapsOthers reports whether added overlaps any of rects besides r, so
+// snapping r would make it overlap them
+func overlapsOthers(added image.Rectangle, r *image.Rectangle, rects canny.Rectangles) bool {
+	for _, other := range rects {
+		if other != r && added.Overlaps(*other) {
+			return true
+		}
+	}
+
+	return false
+}
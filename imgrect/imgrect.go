@@ -0,0 +1,729 @@
+// Package imgrect finds rectangles in images that are calm enough to place
+// text on, and ranks given rectangles by how busy they are.
+package imgrect
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"github.com/wieni/go-imgrect/asset"
+	"github.com/wieni/go-imgrect/canny"
+)
+
+const (
+	// DefaultAmount of rectangles returned by Weighted
+	DefaultAmount = 5
+
+	// DefaultMaxImageSize is the size images are scaled down to
+	DefaultMaxImageSize = 800
+
+	// Thresholds are raised up to DefaultMaxThreshold only when fewer
+	// rectangles than requested with MinAmount are found below
+	// DefaultSoftMaxThreshold
+	DefaultSoftMaxThreshold = 20
+	DefaultMaxThreshold     = 100
+)
+
+// InsufficientError is returned by Weighted when fewer than the required
+// amount of rectangles could be found
+type InsufficientError struct {
+	Found    int
+	Required int
+	// Region is the index of the region, -1 without regions
+	Region int
+}
+
+func (e *InsufficientError) Error() string {
+	if e.Region >= 0 {
+		return fmt.Sprintf("Insufficient rectangles in region %d: found %d of %d", e.Region, e.Found, e.Required)
+	}
+
+	return fmt.Sprintf("Insufficient rectangles: found %d of %d", e.Found, e.Required)
+}
+
+var rectFont *truetype.Font
+
+func init() {
+	raw := asset.MustAsset("assets/WorkSans-Regular.ttf")
+	var err error
+	rectFont, err = loadFont(bytes.NewReader(raw))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// loadFont loads a truetype font
+func loadFont(r io.Reader) (*truetype.Font, error) {
+	rawFont, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return freetype.ParseFont(rawFont)
+}
+
+// PercentPoint contains both X, Y and %X, %Y
+type PercentPoint struct {
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	PercentX float64 `json:"%x"`
+	PercentY float64 `json:"%y"`
+}
+
+func (p *PercentPoint) absoluteX(srcWidth, dstWidth int) int {
+	if p.PercentX == 0 {
+		return int(float64(p.X) / float64(srcWidth) * float64(dstWidth))
+	}
+
+	return int(float64(dstWidth) * p.PercentX)
+}
+
+func (p *PercentPoint) absoluteY(srcHeight, dstHeight int) int {
+	if p.PercentY == 0 {
+		return int(float64(p.Y) / float64(srcHeight) * float64(dstHeight))
+	}
+
+	return int(float64(dstHeight) * p.PercentY)
+}
+
+// PercentRectangle like image.Rectangle defines a Min and Max point
+type PercentRectangle struct {
+	Min   *PercentPoint   `json:"min"`
+	Max   *PercentPoint   `json:"max"`
+	Score *PlacementScore `json:"score,omitempty"`
+	Color *ColorAdvice    `json:"color,omitempty"`
+}
+
+// absolute returns the rectangle in a dstWidth x dstHeight version of a
+// srcWidth x srcHeight image
+func (r *PercentRectangle) absolute(srcWidth, srcHeight, dstWidth, dstHeight int) image.Rectangle {
+	return image.Rect(
+		r.Min.absoluteX(srcWidth, dstWidth),
+		r.Min.absoluteY(srcHeight, dstHeight),
+		r.Max.absoluteX(srcWidth, dstWidth),
+		r.Max.absoluteY(srcHeight, dstHeight),
+	)
+}
+
+// NewPercentRectangle interprets values < 1 as percentages and other
+// values as pixels
+func NewPercentRectangle(x1, y1, x2, y2 float64) *PercentRectangle {
+	raw := [4]float64{x1, y1, x2, y2}
+	var ints [4]int
+	var values [4]float64
+	for i, val := range raw {
+		if val < 1 {
+			values[i] = val
+			continue
+		}
+
+		ints[i] = int(val)
+	}
+
+	return &PercentRectangle{
+		Min: &PercentPoint{ints[0], ints[1], values[0], values[1]},
+		Max: &PercentPoint{ints[2], ints[3], values[2], values[3]},
+	}
+}
+
+// annotate sets the score and color advice of each rectangle
+func annotate(
+	rects []*PercentRectangle,
+	scores []*PlacementScore,
+	colors []*ColorAdvice,
+) []*PercentRectangle {
+	for i := range rects {
+		rects[i].Score = scores[i]
+		rects[i].Color = colors[i]
+	}
+
+	return rects
+}
+
+// toPercentRectangles returns a slice of percentRectangles
+// Percentage is calculated based on srcWidth and srcHeight
+// new X and Y based on dstWidth and dstHeight
+func toPercentRectangles(
+	r canny.Rectangles,
+	srcWidth,
+	srcHeight,
+	dstWidth,
+	dstHeight int,
+) []*PercentRectangle {
+	rects := make([]*PercentRectangle, len(r))
+	sw := float64(srcWidth)
+	sh := float64(srcHeight)
+
+	for i := range r {
+		minxp := float64(r[i].Min.X) / sw
+		minyp := float64(r[i].Min.Y) / sh
+		maxxp := float64(r[i].Max.X) / sw
+		maxyp := float64(r[i].Max.Y) / sh
+
+		rects[i] = &PercentRectangle{
+			Min: &PercentPoint{
+				int(float64(dstWidth) * minxp),
+				int(float64(dstHeight) * minyp),
+				minxp,
+				minyp,
+			},
+			Max: &PercentPoint{
+				int(float64(dstWidth) * maxxp),
+				int(float64(dstHeight) * maxyp),
+				maxxp,
+				maxyp,
+			},
+		}
+	}
+
+	return rects
+}
+
+// Bound is the score of one of the bounds passed to Bounded
+type Bound struct {
+	// Index of the bound in BoundedOptions.Bounds
+	Index int     `json:"index"`
+	Score float64 `json:"score"`
+}
+
+// Bounds sorts from the calmest to the busiest bound
+type Bounds []*Bound
+
+func (b Bounds) Len() int      { return len(b) }
+func (b Bounds) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b Bounds) Less(i, j int) bool {
+	return b[i].Score*b[i].Score < b[j].Score*b[j].Score
+}
+
+// Stats describe the work done by Weighted or Bounded
+type Stats struct {
+	// Width and Height of the decoded image
+	Width  int
+	Height int
+	// Decode is the time spent loading the image
+	Decode time.Duration
+	// Iterations of the detector, one per threshold or bound
+	Iterations int
+}
+
+// BoundedOptions are the parameters of Bounded
+type BoundedOptions struct {
+	// Bounds to score, see PercentRectangle for their units
+	Bounds []*PercentRectangle
+	// MaxImageSize the image is scaled down to, DefaultMaxImageSize when 0
+	MaxImageSize int
+	// Stats are filled in when set
+	Stats *Stats
+}
+
+// Bounded scores the bounds of the image in reader by how busy they are.
+// It stops with the error of ctx when ctx is done.
+func Bounded(ctx context.Context, reader io.Reader, opts BoundedOptions) (Bounds, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := opts.Stats
+	if stats == nil {
+		stats = &Stats{}
+	}
+
+	start := time.Now()
+	maxImageSize := opts.MaxImageSize
+	if maxImageSize == 0 {
+		maxImageSize = DefaultMaxImageSize
+	}
+
+	img, w, h, err := canny.Load(reader, maxImageSize)
+	stats.Decode = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Width = w
+	stats.Height = h
+
+	defer img.Release()
+	rw := img.Width()
+	rh := img.Height()
+
+	rects := opts.Bounds
+	_rects := make([]*image.Rectangle, len(rects))
+	for i := range rects {
+		rect := rects[i].absolute(w, h, rw, rh)
+		_rects[i] = &rect
+	}
+
+	imgs, err := canny.CropBounds(img, _rects)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(Bounds, len(imgs))
+	for i := range imgs {
+		stats.Iterations++
+		img, err := canny.Canny(ctx, imgs[i], 3, 3, false)
+		if err != nil {
+			return nil, err
+		}
+
+		defer img.Release()
+		scores[i] = &Bound{i, img.Mean()}
+	}
+
+	sort.Sort(scores)
+	return scores, nil
+}
+
+// Padding in pixels of the original image
+type Padding struct {
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+}
+
+// WeightedOptions are the parameters of Weighted
+type WeightedOptions struct {
+	// Amount of rectangles to return, DefaultAmount when 0
+	Amount int
+	// MinAmount of rectangles, an InsufficientError is returned when fewer
+	// are found
+	MinAmount int
+	// MinWidth and MinHeight of each rectangle in pixels, or in fractions
+	// of the image size when smaller than 1
+	MinWidth  float64
+	MinHeight float64
+	// MinAspect and MaxAspect bound the width / height ratio of each
+	// rectangle, the largest calm rectangles within the bounds are
+	// returned. A bound of 0 is not checked.
+	MinAspect float64
+	MaxAspect float64
+	// Padding excludes the borders of the image
+	Padding Padding
+	// Regions to search instead of the whole image, each with its own
+	// minimum size and amount. Optional.
+	Regions []*Region
+	// KeepOut rectangles may not be crossed by any rectangle
+	KeepOut []*PercentRectangle
+	// Mask is a png of which the light pixels may not be crossed by any
+	// rectangle, it is scaled to the image. Optional.
+	Mask io.Reader
+	// Detector finds busy pixels, canny.DefaultDetector when nil
+	Detector canny.Detector
+	// Composition is CompositionCenter (default) or CompositionThirds
+	Composition string
+	// Gravity prefers rectangles near a side, corner or the center of the
+	// image over the composition, see GravityNames. Optional.
+	Gravity string
+	// Snap moves the edges of rectangles on the side of the gravity to
+	// the border of their region or padding when they are within this
+	// distance, in pixels or in fractions of the image size when smaller
+	// than 1. Edges are not moved over busy or keep out pixels.
+	Snap float64
+	// Text that has to fit in each rectangle, optional
+	Text *TextOptions
+	// Preview receives a jpeg of the image with the rectangles, optional
+	Preview io.Writer
+	// Faces protects the faces in the image with FacesDrop or
+	// FacesPenalize, faces are not detected when empty
+	Faces string
+	// FaceCascade detects faces, DefaultCascade when nil
+	FaceCascade *canny.Cascade
+	// MaxImageSize the image is scaled down to, DefaultMaxImageSize when 0
+	MaxImageSize int
+	// SoftMaxThreshold and MaxThreshold limit the thresholds of the
+	// detector, see DefaultSoftMaxThreshold. Defaults are used when 0.
+	SoftMaxThreshold float64
+	MaxThreshold     float64
+	// Stats are filled in when set
+	Stats *Stats
+}
+
+// WeightedResult contains the rectangles found by Weighted, best first
+type WeightedResult struct {
+	Rects []*PercentRectangle `json:"rects"`
+	// Fit is set when fitting text
+	Fit *TextFit `json:"fit,omitempty"`
+	// Faces that were detected, if requested
+	Faces []*PercentRectangle `json:"faces,omitempty"`
+	// Regions contains the rectangles by region when searching regions,
+	// Rects contains those of all regions in order
+	Regions []*RegionResult `json:"regions,omitempty"`
+}
+
+// Weighted finds calm rectangles in the image in reader. It stops with the
+// error of ctx when ctx is done.
+func Weighted(ctx context.Context, reader io.Reader, opts WeightedOptions) (*WeightedResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	amount := opts.Amount
+	if amount == 0 {
+		amount = DefaultAmount
+	}
+
+	minAmount := opts.MinAmount
+	minWidth := opts.MinWidth
+	padding := opts.Padding
+	detector := opts.Detector
+	composition := opts.Composition
+	text := opts.Text
+	preview := opts.Preview
+	stats := opts.Stats
+	if stats == nil {
+		stats = &Stats{}
+	}
+
+	maxImageSize := opts.MaxImageSize
+	if maxImageSize == 0 {
+		maxImageSize = DefaultMaxImageSize
+	}
+
+	softMaxThreshold := opts.SoftMaxThreshold
+	if softMaxThreshold == 0 {
+		softMaxThreshold = DefaultSoftMaxThreshold
+	}
+
+	maxThreshold := opts.MaxThreshold
+	if maxThreshold == 0 {
+		maxThreshold = DefaultMaxThreshold
+	}
+
+	if amount < 1 {
+		amount = 1
+	}
+
+	if minAmount > amount {
+		minAmount = amount
+	}
+
+	if detector == nil {
+		detector = canny.DefaultDetector
+	}
+
+	var fontCtx *freetype.Context
+	if text != nil && text.Font != nil {
+		font, err := loadFont(text.Font)
+		if err != nil {
+			return nil, ErrFontLoadFailed
+		}
+
+		fontCtx = freetype.NewContext()
+		fontCtx.SetDPI(72)
+		fontCtx.SetFontSize(text.Size)
+		fontCtx.SetFont(font)
+	}
+
+	start := time.Now()
+	_img, origWidth, origHeight, err := canny.Load(reader, maxImageSize)
+	stats.Decode = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Width = origWidth
+	stats.Height = origHeight
+
+	defer _img.Release()
+	width := _img.Width()
+	height := _img.Height()
+
+	var faces canny.Rectangles
+	if opts.Faces != "" {
+		cascade := opts.FaceCascade
+		if cascade == nil {
+			cascade, err = DefaultCascade()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		faces, err = cascade.Detect(ctx, _img)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if minWidth < 1 {
+		minWidth = float64(origWidth) * minWidth
+	}
+
+	var block *textBlock
+	if fontCtx != nil {
+		block, err = layoutText(fontCtx, text, text.size(), int(minWidth))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ratio := float64(width) / float64(origWidth)
+
+	// minSize returns the minimum size of rectangles in the scaled image,
+	// they fit the text if any
+	minSize := func(w, h float64) (float64, float64) {
+		if w < 1 {
+			w = float64(origWidth) * w
+		}
+
+		if h < 1 {
+			h = float64(origHeight) * h
+		}
+
+		if block != nil {
+			w = math.Max(w, float64(block.width))
+			h = math.Max(h, float64(block.height))
+		}
+
+		return w * ratio, h * ratio
+	}
+
+	var region *image.Rectangle
+	if (Padding{}) != padding {
+		_region := image.Rect(
+			int(ratio*float64(padding.Left)),
+			int(ratio*float64(padding.Top)),
+			int(ratio*float64(origWidth-padding.Right)),
+			int(ratio*float64(origHeight-padding.Bottom)),
+		)
+		region = &_region
+	}
+
+	area := &searchArea{bounds: region, amount: amount, minAmount: minAmount}
+	area.minWidth, area.minHeight = minSize(opts.MinWidth, opts.MinHeight)
+	areas := []*searchArea{area}
+	if len(opts.Regions) != 0 {
+		areas = make([]*searchArea, len(opts.Regions))
+		for i, r := range opts.Regions {
+			bounds := r.Bounds.absolute(origWidth, origHeight, width, height)
+			if region != nil {
+				bounds = bounds.Intersect(*region)
+			}
+
+			if bounds.Empty() {
+				return nil, canny.ErrInvalidBounds
+			}
+
+			areas[i] = &searchArea{bounds: &bounds, amount: amount, minAmount: minAmount}
+			if r.Amount != 0 {
+				areas[i].amount = r.Amount
+				areas[i].minAmount = minInt(minAmount, r.Amount)
+			}
+
+			w, h := opts.MinWidth, opts.MinHeight
+			if r.MinWidth != 0 {
+				w = r.MinWidth
+			}
+
+			if r.MinHeight != 0 {
+				h = r.MinHeight
+			}
+
+			areas[i].minWidth, areas[i].minHeight = minSize(w, h)
+		}
+	}
+
+	mask, err := keepOutMask(opts.KeepOut, opts.Mask, origWidth, origHeight, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &searcher{
+		img:              _img,
+		detector:         detector,
+		mask:             mask,
+		faces:            faces,
+		dropFaces:        opts.Faces == FacesDrop,
+		minAspect:        opts.MinAspect,
+		maxAspect:        opts.MaxAspect,
+		softMaxThreshold: softMaxThreshold,
+		maxThreshold:     maxThreshold,
+		stats:            stats,
+	}
+	defer s.release()
+
+	groups := make([]canny.Rectangles, len(areas))
+	for i, area := range areas {
+		groups[i], err = s.find(ctx, area)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(groups[i]) < area.minAmount {
+			ierr := &InsufficientError{len(groups[i]), area.minAmount, -1}
+			if len(opts.Regions) != 0 {
+				ierr.Region = i
+			}
+
+			return nil, ierr
+		}
+	}
+
+	// The edges are released with those of the search
+	edges, err := s.detect(ctx, scoreThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	colorImg := _img.Color()
+
+	var rects canny.Rectangles
+	var scores []*PlacementScore
+	var colors []*ColorAdvice
+	sizes := make([]int, len(groups))
+	if a, ok := gravities[opts.Gravity]; ok && opts.Snap > 0 {
+		tolX := opts.Snap * ratio
+		tolY := opts.Snap * ratio
+		if opts.Snap < 1 {
+			tolX = opts.Snap * float64(width)
+			tolY = opts.Snap * float64(height)
+		}
+
+		for i, group := range groups {
+			bounds := image.Rect(0, 0, width, height)
+			if areas[i].bounds != nil {
+				bounds = *areas[i].bounds
+			}
+
+			for _, r := range group {
+				snap(r, a, int(tolX), int(tolY), bounds, func(added image.Rectangle) bool {
+					return s.free(added) && s.calm(r, added) && !overlapsOthers(added, r, group)
+				})
+
+				// Snapping may stretch rectangles beyond the aspect bounds
+				keepAspect(r, a, opts.MinAspect, opts.MaxAspect)
+			}
+		}
+	}
+
+	for i, group := range groups {
+		aspect := targetAspect(areas[i], opts.MinAspect, opts.MaxAspect)
+		groupScores := scoreRects(group, edges, aspect, composition, opts.Gravity)
+		if opts.Faces == FacesPenalize {
+			penalizeFaces(group, groupScores, faces)
+		}
+
+		n := minInt(areas[i].amount, len(group))
+		sizes[i] = n
+		rects = append(rects, group[:n]...)
+		scores = append(scores, groupScores[:n]...)
+		for _, r := range group[:n] {
+			colors = append(colors, adviseColor(colorImg, *r))
+		}
+	}
+
+	var fit *TextFit
+	if block != nil && text.Fit {
+		fit, err = fitText(fontCtx, text, rects, ratio)
+		if err != nil {
+			return nil, err
+		}
+
+		baselines := fit.block.baselines(*rects[fit.Rect], ratio)
+		fit.Baselines = make([]*PercentPoint, len(baselines))
+		for i, p := range baselines {
+			fit.Baselines[i] = &PercentPoint{
+				int(float64(p.X) / ratio),
+				int(float64(p.Y) / ratio),
+				float64(p.X) / float64(width),
+				float64(p.Y) / float64(height),
+			}
+		}
+	}
+
+	result := &WeightedResult{
+		Rects: annotate(toPercentRectangles(rects, width, height, origWidth, origHeight), scores, colors),
+		Fit:   fit,
+		Faces: toPercentRectangles(faces, width, height, origWidth, origHeight),
+	}
+
+	if len(opts.Regions) != 0 {
+		result.Regions = make([]*RegionResult, len(sizes))
+		rest := result.Rects
+		for i, n := range sizes {
+			result.Regions[i] = &RegionResult{rest[:n]}
+			rest = rest[n:]
+		}
+	}
+
+	if preview == nil {
+		return result, nil
+	}
+
+	overlayColor := image.NewUniform(color.NRGBA{A: 255, R: 255})
+	goimg := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(goimg, goimg.Rect, colorImg, colorImg.Bounds().Min, draw.Src)
+
+	if block != nil && len(rects) != 0 {
+		fontCtx.SetClip(goimg.Bounds())
+		fontCtx.SetDst(goimg)
+		for i, rect := range rects {
+			b := block
+			if fit != nil {
+				if i != fit.Rect {
+					continue
+				}
+
+				b = fit.block
+			}
+
+			fontCtx.SetSrc(overlayColor)
+			if colors[i] != nil {
+				fontCtx.SetSrc(image.NewUniform(colors[i].foreground))
+			}
+
+			b.draw(fontCtx, *rect, ratio)
+		}
+	}
+
+	for i, rect := range rects {
+		s := 20
+		ctx := freetype.NewContext()
+		ctx.SetDPI(72)
+		ctx.SetClip(goimg.Bounds())
+		ctx.SetFontSize(float64(s))
+		ctx.SetFont(rectFont)
+		ctx.SetDst(goimg)
+		ctx.SetSrc(overlayColor)
+		ctx.DrawString(
+			fmt.Sprintf("%d.", i+1),
+			freetype.Pt(rect.Min.X+5, rect.Min.Y+s+10),
+		)
+
+		outline(goimg, rect, overlayColor)
+	}
+
+	faceColor := image.NewUniform(color.NRGBA{A: 255, B: 255})
+	for _, face := range faces {
+		outline(goimg, face, faceColor)
+	}
+
+	jpeg.Encode(preview, goimg, nil)
+	return result, nil
+}
+
+// outline draws the border of rect on img
+func outline(img draw.Image, rect *image.Rectangle, c color.Color) {
+	for x := rect.Min.X; x < rect.Max.X; x++ {
+		img.Set(x, rect.Min.Y, c)
+		img.Set(x, rect.Max.Y-1, c)
+	}
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		img.Set(rect.Min.X, y, c)
+		img.Set(rect.Max.X-1, y, c)
+	}
+}
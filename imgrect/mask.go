@@ -0,0 +1,70 @@
+package imgrect
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/wieni/go-imgrect/canny"
+)
+
+// ErrMaskLoadFailed is returned by Weighted when the mask is not a png
+var ErrMaskLoadFailed = errors.New("Mask failed to load")
+
+// maskThreshold is the intensity from which pixels of a mask are busy
+const maskThreshold = 128
+
+// keepOutMask returns a width x height mask of the keep out rectangles and
+// the light pixels of the png in mask, or nil when there are none. The
+// rectangles are relative to a origWidth x origHeight image, the png is
+// scaled to the mask.
+func keepOutMask(
+	keepOut []*PercentRectangle,
+	mask io.Reader,
+	origWidth,
+	origHeight,
+	width,
+	height int,
+) (*canny.Mask, error) {
+	if len(keepOut) == 0 && mask == nil {
+		return nil, nil
+	}
+
+	m := canny.NewMask(width, height)
+	for _, r := range keepOut {
+		m.Fill(r.absolute(origWidth, origHeight, width, height))
+	}
+
+	if mask == nil {
+		return m, nil
+	}
+
+	src, err := png.Decode(mask)
+	if err != nil {
+		return nil, ErrMaskLoadFailed
+	}
+
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		sy := b.Min.Y + y*b.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := b.Min.X + x*b.Dx()/width
+			if color.GrayModel.Convert(src.At(sx, sy)).(color.Gray).Y >= maskThreshold {
+				m.Set(x, y)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// cropMask returns the part of mask within region, either may be nil
+func cropMask(mask *canny.Mask, region *image.Rectangle) (*canny.Mask, error) {
+	if mask == nil || region == nil {
+		return mask, nil
+	}
+
+	return mask.Crop(region)
+}
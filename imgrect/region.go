@@ -0,0 +1,199 @@
+package imgrect
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sort"
+
+	"github.com/wieni/go-imgrect/canny"
+)
+
+// Region is a part of the image to search rectangles in, with its own
+// minimum size and amount of rectangles
+type Region struct {
+	// Bounds of the region, see PercentRectangle for their units
+	Bounds *PercentRectangle
+	// MinWidth and MinHeight like those of WeightedOptions, the ones of
+	// WeightedOptions are used when 0
+	MinWidth  float64
+	MinHeight float64
+	// Amount of rectangles to return, the one of WeightedOptions when 0
+	Amount int
+}
+
+// RegionResult contains the rectangles found in a region, best first
+type RegionResult struct {
+	Rects []*PercentRectangle `json:"rects"`
+}
+
+// searchArea is a part of the scaled image to search rectangles in
+type searchArea struct {
+	// bounds of the area, the whole image when nil
+	bounds    *image.Rectangle
+	minWidth  float64
+	minHeight float64
+	amount    int
+	minAmount int
+}
+
+// searcher finds rectangles in the areas of a scaled image. The detector
+// runs once per threshold for all areas.
+type searcher struct {
+	img              *canny.Image
+	detector         canny.Detector
+	mask             *canny.Mask
+	faces            canny.Rectangles
+	dropFaces        bool
+	minAspect        float64
+	maxAspect        float64
+	softMaxThreshold float64
+	maxThreshold     float64
+	stats            *Stats
+	detected         map[float64]*canny.Image
+	// thresholds contains the threshold each rectangle was found at
+	thresholds map[*image.Rectangle]float64
+}
+
+// detect returns the busy pixels of the image at threshold
+func (s *searcher) detect(ctx context.Context, threshold float64) (*canny.Image, error) {
+	if img, ok := s.detected[threshold]; ok {
+		return img, nil
+	}
+
+	s.stats.Iterations++
+	img, err := s.detector.Detect(ctx, s.img, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.detected == nil {
+		s.detected = map[float64]*canny.Image{}
+	}
+
+	s.detected[threshold] = img
+	return img, nil
+}
+
+// free reports whether r crosses no keep out pixels, nor faces when they
+// are dropped
+func (s *searcher) free(r image.Rectangle) bool {
+	if s.mask != nil && !s.mask.Clear(r) {
+		return false
+	}
+
+	return !s.dropFaces || faceOverlap(&r, s.faces) == 0
+}
+
+// calm reports whether added has no busy pixels at the threshold r was
+// found at
+func (s *searcher) calm(r *image.Rectangle, added image.Rectangle) bool {
+	img, ok := s.detected[s.thresholds[r]]
+	if !ok {
+		return false
+	}
+
+	added = added.Intersect(image.Rect(0, 0, img.Width(), img.Height()))
+	for y := added.Min.Y; y < added.Max.Y; y++ {
+		for x := added.Min.X; x < added.Max.X; x++ {
+			if img.At(x, y) != 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// release the images of the detector
+func (s *searcher) release() {
+	for _, img := range s.detected {
+		img.Release()
+	}
+}
+
+// find the rectangles in area. Thresholds are raised until enough
+// rectangles are found.
+func (s *searcher) find(ctx context.Context, area *searchArea) (canny.Rectangles, error) {
+	mask, err := cropMask(s.mask, area.bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	var rects canny.Rectangles
+	for threshold := 0.0; threshold < s.maxThreshold; threshold += 3 {
+		if threshold >= s.softMaxThreshold && len(rects) >= area.minAmount {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		img, err := s.detect(ctx, threshold)
+		if err != nil {
+			return nil, err
+		}
+
+		if area.bounds != nil {
+			imgs, err := canny.CropBounds(img, []*image.Rectangle{area.bounds})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(imgs) != 1 {
+				return nil, errors.New("Invalid amount of images returned from crop")
+			}
+
+			img = imgs[0]
+		}
+
+		var _rects canny.Rectangles
+		if s.minAspect > 0 || s.maxAspect > 0 {
+			_rects, err = canny.FindAspectRects(
+				ctx,
+				img,
+				mask,
+				int(area.minWidth),
+				int(area.minHeight),
+				s.minAspect,
+				s.maxAspect,
+			)
+		} else {
+			_rects, err = canny.FindRects(ctx, img, mask, int(area.minWidth), int(area.minHeight))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if area.bounds != nil {
+			for _, r := range _rects {
+				*r = r.Add(area.bounds.Min)
+			}
+		}
+
+		if s.dropFaces {
+			_rects = dropFaces(_rects, s.faces)
+		}
+
+		sort.Sort(_rects)
+		rects = append(rects, _rects...)
+		rects = canny.FilterOverlap(rects, area.amount*candidateFactor)
+		if s.thresholds == nil {
+			s.thresholds = map[*image.Rectangle]float64{}
+		}
+
+		for _, r := range rects {
+			if _, ok := s.thresholds[r]; !ok {
+				s.thresholds[r] = threshold
+			}
+		}
+
+		if len(rects) >= area.amount {
+			break
+		}
+	}
+
+	return rects, nil
+}
@@ -0,0 +1,184 @@
+package imgrect
+
+import (
+	"math"
+	"sort"
+
+	"github.com/wieni/go-imgrect/canny"
+)
+
+const (
+	// candidateFactor times the requested amount of rectangles are
+	// collected before they are ranked by score
+	candidateFactor = 3
+
+	// threshold of the edge map used to score rectangles
+	scoreThreshold = 3
+
+	CompositionCenter = "center"
+	CompositionThirds = "thirds"
+)
+
+// weights of the score components, they add up to 1
+const (
+	calmWeight     = 0.35
+	positionWeight = 0.25
+	aspectWeight   = 0.2
+	areaWeight     = 0.2
+)
+
+// PlacementScore rates how well text can be placed in a rectangle.
+// All components range from 0 (bad) to 1 (good).
+type PlacementScore struct {
+	Total    float64 `json:"total"`
+	Calm     float64 `json:"calm"`
+	Position float64 `json:"position"`
+	Aspect   float64 `json:"aspect"`
+	Area     float64 `json:"area"`
+}
+
+// scoredRects sorts rectangles by descending total score
+type scoredRects struct {
+	rects  canny.Rectangles
+	scores []*PlacementScore
+}
+
+func (s scoredRects) Len() int { return len(s.rects) }
+func (s scoredRects) Swap(i, j int) {
+	s.rects[i], s.rects[j] = s.rects[j], s.rects[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+func (s scoredRects) Less(i, j int) bool {
+	return s.scores[i].Total > s.scores[j].Total
+}
+
+// integral returns the summed area table of the busy pixels in edges
+func integral(edges *canny.Image) []int {
+	w := edges.Width()
+	h := edges.Height()
+	sum := make([]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			busy := 0
+			if edges.At(x, y) != 0 {
+				busy = 1
+			}
+
+			sum[(w+1)*(y+1)+x+1] = busy +
+				sum[(w+1)*y+x+1] +
+				sum[(w+1)*(y+1)+x] -
+				sum[(w+1)*y+x]
+		}
+	}
+
+	return sum
+}
+
+// positionScore rates the center of r within a w x h image. With the
+// thirds composition rectangles near the rule of thirds lines score best,
+// otherwise rectangles near the center of the image do.
+func positionScore(composition string, cx, cy, w, h float64) float64 {
+	if composition == CompositionThirds {
+		dx := math.Min(math.Abs(cx-w/3), math.Abs(cx-2*w/3)) / (w / 3)
+		dy := math.Min(math.Abs(cy-h/3), math.Abs(cy-2*h/3)) / (h / 3)
+		return 1 - math.Min(1, math.Min(dx, dy))
+	}
+
+	dist := math.Hypot(cx-w/2, cy-h/2)
+	return 1 - dist/math.Hypot(w/2, h/2)
+}
+
+// targetAspect returns the width / height ratio rectangles are scored
+// against: the middle of the aspect bounds when they are set, otherwise
+// the ratio of the minimum size of the area
+func targetAspect(area *searchArea, minAspect, maxAspect float64) float64 {
+	switch {
+	case minAspect > 0 && maxAspect > 0:
+		return (minAspect + maxAspect) / 2
+	case minAspect > 0:
+		return minAspect
+	case maxAspect > 0:
+		return maxAspect
+	case area.minHeight > 0:
+		return area.minWidth / area.minHeight
+	}
+
+	return 0
+}
+
+// scoreRects scores every rectangle and sorts them by descending score.
+// edges is the busy map the rectangles were found in, targetAspect the
+// width / height ratio of the requested text box. A gravity replaces the
+// composition in the position score.
+func scoreRects(
+	rects canny.Rectangles,
+	edges *canny.Image,
+	targetAspect float64,
+	composition string,
+	gravity string,
+) []*PlacementScore {
+	w := edges.Width()
+	h := edges.Height()
+	sum := integral(edges)
+
+	maxArea := 0
+	for _, r := range rects {
+		maxArea = maxInt(maxArea, r.Dx()*r.Dy())
+	}
+
+	scores := make([]*PlacementScore, len(rects))
+	for i, r := range rects {
+		area := r.Dx() * r.Dy()
+		busy := sum[(w+1)*r.Max.Y+r.Max.X] -
+			sum[(w+1)*r.Min.Y+r.Max.X] -
+			sum[(w+1)*r.Max.Y+r.Min.X] +
+			sum[(w+1)*r.Min.Y+r.Min.X]
+
+		score := &PlacementScore{
+			Calm: 1 - float64(busy)/float64(area),
+			Position: positionScore(
+				composition,
+				float64(r.Min.X+r.Max.X)/2,
+				float64(r.Min.Y+r.Max.Y)/2,
+				float64(w),
+				float64(h),
+			),
+			Aspect: 1,
+			Area:   float64(area) / float64(maxArea),
+		}
+
+		if a, ok := gravities[gravity]; ok {
+			score.Position = gravityScore(a, r, float64(w), float64(h))
+		}
+
+		if targetAspect > 0 {
+			aspect := float64(r.Dx()) / float64(r.Dy())
+			score.Aspect = math.Min(aspect, targetAspect) / math.Max(aspect, targetAspect)
+		}
+
+		score.Total = calmWeight*score.Calm +
+			positionWeight*score.Position +
+			aspectWeight*score.Aspect +
+			areaWeight*score.Area
+		scores[i] = score
+	}
+
+	sort.Sort(scoredRects{rects, scores})
+	return scores
+}
+
+func maxInt(n, m int) int {
+	if n > m {
+		return n
+	}
+
+	return m
+}
+
+func minInt(n, m int) int {
+	if n < m {
+		return n
+	}
+
+	return m
+}
@@ -0,0 +1,335 @@
+package imgrect
+
+import (
+	"errors"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/golang/freetype"
+	"github.com/wieni/go-imgrect/canny"
+)
+
+const (
+	defaultLineHeight = 1.2
+	MaxTextLines      = 20
+
+	AlignLeft   = "left"
+	AlignCenter = "center"
+	AlignRight  = "right"
+)
+
+// ErrTooManyLines is returned when text contains more lines than allowed
+var ErrTooManyLines = errors.New("Text does not fit in the maximum amount of lines")
+
+// ErrFontLoadFailed is returned when the font of the text is not a
+// truetype font
+var ErrFontLoadFailed = errors.New("Font failed to load")
+
+// ErrTextDoesNotFit is returned when text does not fit in any rectangle
+// at the minimum font size
+var ErrTextDoesNotFit = errors.New("Text does not fit in any rectangle")
+
+// TextOptions describe the text that has to fit in each rectangle
+type TextOptions struct {
+	Font io.Reader
+	Size float64
+	Text string
+	// MaxLines the text may be wrapped into, 1 by default
+	MaxLines int
+	// LineHeight in multiples of Size, 1.2 by default
+	LineHeight float64
+	// Align lines left, center or right within the block
+	Align string
+	// MinSize and MaxSize bound the font size when Fit is set
+	Fit     bool
+	MinSize float64
+	MaxSize float64
+}
+
+// size of the font used to find rectangles
+func (opts *TextOptions) size() float64 {
+	if opts.Fit {
+		return opts.MinSize
+	}
+
+	return opts.Size
+}
+
+func (opts *TextOptions) maxLines() int {
+	if opts.MaxLines < 1 {
+		return 1
+	}
+
+	return opts.MaxLines
+}
+
+func (opts *TextOptions) lineHeight() float64 {
+	if opts.LineHeight <= 0 {
+		return defaultLineHeight
+	}
+
+	return opts.LineHeight
+}
+
+// TextFit is the largest font size at which text fits in one of the
+// rectangles
+type TextFit struct {
+	FontSize float64 `json:"fontsize"`
+	// Rect is the index of the rectangle the text fits in
+	Rect  int      `json:"rect"`
+	Lines []string `json:"lines"`
+	// Baselines contains the starting point of the baseline of each line
+	Baselines []*PercentPoint `json:"baselines"`
+
+	block *textBlock
+}
+
+// textBlock is text wrapped into lines
+type textBlock struct {
+	lines      []string
+	widths     []int
+	width      int
+	height     int
+	size       float64
+	lineHeight float64
+	align      string
+}
+
+// measureString returns the width of s in pixels. ctx must not have a clip
+// set, or the string is drawn as well.
+func measureString(ctx *freetype.Context, s string) (int, error) {
+	pos, err := ctx.DrawString(s, freetype.Pt(0, 0))
+	if err != nil {
+		return 0, err
+	}
+
+	return pos.X.Round(), nil
+}
+
+// wrapText wraps the words of each paragraph into lines no wider than
+// maxWidth. Words wider than maxWidth get a line of their own.
+func wrapText(ctx *freetype.Context, paragraphs [][]string, maxWidth int) ([]string, []int, error) {
+	var lines []string
+	var widths []int
+
+	for _, words := range paragraphs {
+		line := ""
+		width := 0
+		for _, word := range words {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+
+			w, err := measureString(ctx, candidate)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if line == "" || w <= maxWidth {
+				line = candidate
+				width = w
+				continue
+			}
+
+			lines = append(lines, line)
+			widths = append(widths, width)
+			line = word
+			width, err = measureString(ctx, word)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		lines = append(lines, line)
+		widths = append(widths, width)
+	}
+
+	return lines, widths, nil
+}
+
+// splitWords splits text into paragraphs of words
+func splitWords(text string) [][]string {
+	var paragraphs [][]string
+	for _, p := range strings.Split(text, "\n") {
+		paragraphs = append(paragraphs, strings.Fields(p))
+	}
+
+	return paragraphs
+}
+
+func newTextBlock(opts *TextOptions, size float64, lines []string, widths []int) *textBlock {
+	block := &textBlock{
+		lines:      lines,
+		widths:     widths,
+		size:       size,
+		lineHeight: opts.lineHeight(),
+		align:      opts.Align,
+	}
+
+	for _, w := range widths {
+		block.width = maxInt(block.width, w)
+	}
+
+	block.height = int(size + float64(len(lines)-1)*block.lineHeight*size)
+	return block
+}
+
+// layoutText wraps the text at the given font size into the narrowest block
+// of at most opts.MaxLines lines that is at least minWidth wide.
+func layoutText(ctx *freetype.Context, opts *TextOptions, size float64, minWidth int) (*textBlock, error) {
+	ctx.SetFontSize(size)
+	paragraphs := splitWords(opts.Text)
+	if len(paragraphs) > opts.maxLines() {
+		return nil, ErrTooManyLines
+	}
+
+	lo := minWidth
+	hi := minWidth
+	for _, words := range paragraphs {
+		for _, word := range words {
+			w, err := measureString(ctx, word)
+			if err != nil {
+				return nil, err
+			}
+
+			lo = maxInt(lo, w)
+		}
+
+		w, err := measureString(ctx, strings.Join(words, " "))
+		if err != nil {
+			return nil, err
+		}
+
+		hi = maxInt(hi, w)
+	}
+
+	// Find the narrowest width at which the text fits in maxLines, every
+	// paragraph fits on a single line at hi
+	for lo < hi {
+		mid := (lo + hi) / 2
+		lines, _, err := wrapText(ctx, paragraphs, mid)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(lines) > opts.maxLines() {
+			lo = mid + 1
+			continue
+		}
+
+		hi = mid
+	}
+
+	lines, widths, err := wrapText(ctx, paragraphs, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTextBlock(opts, size, lines, widths), nil
+}
+
+// fitBlock wraps the text at the given font size into a width x height
+// block, it returns nil if the text does not fit.
+func fitBlock(ctx *freetype.Context, opts *TextOptions, size float64, width, height int) (*textBlock, error) {
+	ctx.SetFontSize(size)
+	lines, widths, err := wrapText(ctx, splitWords(opts.Text), width)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) > opts.maxLines() {
+		return nil, nil
+	}
+
+	block := newTextBlock(opts, size, lines, widths)
+	if block.width > width || block.height > height {
+		return nil, nil
+	}
+
+	return block, nil
+}
+
+// fitText finds the largest integer font size between opts.MinSize and
+// opts.MaxSize at which the text fits in one of the rectangles. The
+// rectangles are scaled by scale compared to the font.
+func fitText(ctx *freetype.Context, opts *TextOptions, rects canny.Rectangles, scale float64) (*TextFit, error) {
+	var fit *TextFit
+	for i, rect := range rects {
+		width := int(float64(rect.Dx()) / scale)
+		height := int(float64(rect.Dy()) / scale)
+
+		lo := int(math.Ceil(opts.MinSize))
+		hi := int(opts.MaxSize)
+		if fit != nil {
+			// Only larger sizes improve the fit
+			lo = int(fit.FontSize) + 1
+		}
+
+		var best *textBlock
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			block, err := fitBlock(ctx, opts, float64(mid), width, height)
+			if err != nil {
+				return nil, err
+			}
+
+			if block == nil {
+				hi = mid - 1
+				continue
+			}
+
+			best = block
+			lo = mid + 1
+		}
+
+		if best != nil {
+			fit = &TextFit{
+				FontSize: best.size,
+				Rect:     i,
+				Lines:    best.lines,
+				block:    best,
+			}
+		}
+	}
+
+	if fit == nil {
+		return nil, ErrTextDoesNotFit
+	}
+
+	return fit, nil
+}
+
+// baselines returns the starting point of the baseline of each line when
+// the block is centered in rect, scaled by scale
+func (b *textBlock) baselines(rect image.Rectangle, scale float64) []image.Point {
+	left := float64(rect.Min.X) + (float64(rect.Dx())-float64(b.width)*scale)/2
+	top := float64(rect.Min.Y) + (float64(rect.Dy())-float64(b.height)*scale)/2
+
+	points := make([]image.Point, len(b.lines))
+	for i := range b.lines {
+		x := left
+		switch b.align {
+		case AlignRight:
+			x += float64(b.width-b.widths[i]) * scale
+		case AlignLeft:
+		default:
+			x += float64(b.width-b.widths[i]) * scale / 2
+		}
+
+		y := top + (b.size+float64(i)*b.lineHeight*b.size)*scale
+		points[i] = image.Pt(int(x), int(y))
+	}
+
+	return points
+}
+
+// draw the block centered in rect, scaled by scale
+func (b *textBlock) draw(ctx *freetype.Context, rect image.Rectangle, scale float64) {
+	ctx.SetFontSize(b.size * scale)
+	for i, p := range b.baselines(rect, scale) {
+		ctx.DrawString(b.lines[i], freetype.Pt(p.X, p.Y))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// logLevel of the request logs, see the -loglevel flag
+var logLevel = new(slog.LevelVar)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// maxRequestIDLength limits the X-Request-ID accepted from clients
+const maxRequestIDLength = 128
+
+// requestLog collects what a handler did, it is logged when the request
+// is done
+type requestLog struct {
+	id     string
+	mu     sync.Mutex
+	source string
+	width  int
+	height int
+	params interface{}
+	rects  int
+}
+
+type requestLogKey struct{}
+
+// withRequestLog returns a context carrying entry
+func withRequestLog(ctx context.Context, entry *requestLog) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, entry)
+}
+
+// getRequestLog returns the entry of ctx or, when there is none, an entry
+// that is never logged
+func getRequestLog(ctx context.Context) *requestLog {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return entry
+	}
+
+	return &requestLog{rects: -1}
+}
+
+// setRequest records the source and parameters of a request
+func (e *requestLog) setRequest(source *fileSource, params interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.source = source.describe()
+	e.params = params
+}
+
+// setResult records the size of the decoded image and the amount of
+// rectangles returned
+func (e *requestLog) setResult(width, height, rects int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.width = width
+	e.height = height
+	e.rects = rects
+}
+
+func (e *requestLog) attrs() []slog.Attr {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var attrs []slog.Attr
+	if e.source != "" {
+		attrs = append(attrs, slog.String("source", e.source))
+	}
+
+	if e.params != nil {
+		attrs = append(attrs, slog.Any("params", e.params))
+	}
+
+	if e.width != 0 {
+		attrs = append(attrs, slog.Int("width", e.width), slog.Int("height", e.height))
+	}
+
+	if e.rects >= 0 {
+		attrs = append(attrs, slog.Int("rects", e.rects))
+	}
+
+	return attrs
+}
+
+// logBatchItem logs an item of a /batch request at debug level
+func logBatchItem(ctx context.Context, index int, entry *requestLog, rerr *requestError) {
+	attrs := []slog.Attr{
+		slog.String("request_id", entry.id),
+		slog.Int("index", index),
+	}
+
+	attrs = append(attrs, entry.attrs()...)
+	if rerr != nil {
+		attrs = append(attrs, slog.String("error_code", rerr.Code), slog.String("error", rerr.Message))
+	}
+
+	logger.LogAttrs(ctx, slog.LevelDebug, "batch item", attrs...)
+}
+
+// requestID returns the valid X-Request-ID of r or generates a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	valid := id != "" && len(id) <= maxRequestIDLength
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			valid = false
+			break
+		}
+	}
+
+	if valid {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logRequest logs a request once it is done. Server errors are logged as
+// errors, client errors as warnings.
+func logRequest(
+	r *http.Request,
+	route string,
+	status int,
+	w *statusWriter,
+	err error,
+	entry *requestLog,
+	duration time.Duration,
+) {
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", entry.id),
+		slog.String("method", r.Method),
+		slog.String("route", route),
+		slog.Int("status", status),
+		slog.Float64("duration_ms", float64(duration)/float64(time.Millisecond)),
+	}
+
+	attrs = append(attrs, entry.attrs()...)
+	if w.code != "" {
+		attrs = append(attrs, slog.String("error_code", w.code))
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	} else if w.message != "" {
+		attrs = append(attrs, slog.String("error", w.message))
+	}
+
+	logger.LogAttrs(r.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wieni/go-imgrect/imgrect"
+	"github.com/wieni/go-tls/simplehttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "imgrect_requests_total",
+		Help: "Amount of requests by route and status code.",
+	}, []string{"route", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imgrect_request_duration_seconds",
+		Help:    "Time spent handling requests by route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"route"})
+
+	decodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgrect_decode_duration_seconds",
+		Help:    "Time spent decoding and resizing images.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	detectorIterations = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgrect_detector_iterations",
+		Help:    "Amount of detector runs per image, one per threshold or bound.",
+		Buckets: prometheus.LinearBuckets(1, 3, 12),
+	})
+
+	rectsFound = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgrect_rects_found",
+		Help:    "Amount of rectangles returned per image.",
+		Buckets: prometheus.LinearBuckets(0, 2, 11),
+	})
+
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgrect_fetch_duration_seconds",
+		Help:    "Time spent fetching urls.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	fetchBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imgrect_fetch_bytes",
+		Help:    "Size of fetched files.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		decodeDuration,
+		detectorIterations,
+		rectsFound,
+		fetchDuration,
+		fetchBytes,
+	)
+}
+
+var metricsHandler = promhttp.Handler()
+
+func serveMetrics(w http.ResponseWriter, r *http.Request, l *log.Logger) (errStatus int, err error) {
+	metricsHandler.ServeHTTP(w, r)
+	return
+}
+
+// observeStats records the work done for a single image
+func observeStats(stats *imgrect.Stats) {
+	if stats.Decode != 0 {
+		decodeDuration.Observe(stats.Decode.Seconds())
+	}
+
+	if stats.Iterations != 0 {
+		detectorIterations.Observe(float64(stats.Iterations))
+	}
+}
+
+// statusWriter remembers the status and error written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	code    string
+	message string
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument counts, times and logs the requests handled by fn as route.
+// Responses get the request id and the CORS headers.
+func instrument(route string, fn simplehttp.HandleFunc) simplehttp.HandleFunc {
+	return func(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		cfg.CORS.setHeaders(w, r)
+
+		entry := &requestLog{id: id, rects: -1}
+		r = r.WithContext(withRequestLog(r.Context(), entry))
+		sw := &statusWriter{ResponseWriter: w}
+		errStatus, err := fn(sw, r, l)
+
+		status := sw.status
+		switch {
+		case errStatus != 0:
+			status = errStatus
+		case status == 0 && err != nil:
+			status = http.StatusInternalServerError
+		case status == 0:
+			status = http.StatusOK
+		}
+
+		duration := time.Since(start)
+		requestsTotal.WithLabelValues(route, strconv.Itoa(status)).Inc()
+		requestDuration.WithLabelValues(route).Observe(duration.Seconds())
+		logRequest(r, route, status, sw, err, entry, duration)
+		return errStatus, err
+	}
+}
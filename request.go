@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/wieni/go-imgrect/canny"
+	"github.com/wieni/go-imgrect/imgrect"
+)
+
+// requestError describes why the parameters of a request were rejected
+type requestError struct {
+	Code    string `json:"code,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *requestError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+
+	return e.Field + ": " + e.Message
+}
+
+// fileSource refers to a file by inline (base64) data, by url or
+// by an uploaded multipart file
+type fileSource struct {
+	Base64 []byte `json:"base64,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// File is the name of an uploaded multipart file, see /batch
+	File string `json:"file,omitempty"`
+
+	upload io.ReadCloser
+	header *multipart.FileHeader
+	data   []byte
+	// media expected from URL, images by default
+	media *media
+}
+
+// load reads the whole file, it can be opened again afterwards. Urls are
+// fetched until ctx is done.
+func (f *fileSource) load(ctx context.Context) ([]byte, error) {
+	if f.data != nil {
+		return f.data, nil
+	}
+
+	file, err := f.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f.data = data
+	f.upload = nil
+	return data, nil
+}
+
+// open the file, urls are fetched until ctx is done
+func (f *fileSource) open(ctx context.Context) (io.ReadCloser, error) {
+	if f.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+	}
+
+	if f.upload != nil {
+		return f.upload, nil
+	}
+
+	if f.header != nil {
+		return f.header.Open()
+	}
+
+	if f.File != "" {
+		return nil, fmt.Errorf("No file uploaded as %s", f.File)
+	}
+
+	if len(f.Base64) != 0 {
+		return ioutil.NopCloser(bytes.NewReader(f.Base64)), nil
+	}
+
+	m := f.media
+	if m == nil {
+		m = imageMedia
+	}
+
+	data, err := defaultFetcher.fetch(ctx, f.URL, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// describe the source for logs
+func (f *fileSource) describe() string {
+	switch {
+	case f == nil:
+		return ""
+	case f.URL != "":
+		return f.URL
+	case f.File != "":
+		return "upload:" + f.File
+	case len(f.Base64) != 0:
+		return "base64"
+	}
+
+	return "upload"
+}
+
+func (f *fileSource) validate(field string, required bool) *requestError {
+	if f != nil && (f.upload != nil || f.data != nil) {
+		return nil
+	}
+
+	sources := 0
+	if f != nil {
+		for _, set := range []bool{len(f.Base64) != 0, f.URL != "", f.File != ""} {
+			if set {
+				sources++
+			}
+		}
+	}
+
+	if sources == 0 {
+		if !required {
+			return nil
+		}
+
+		return &requestError{"required", field, "Either base64, url or file is required"}
+	}
+
+	if sources > 1 {
+		return &requestError{"conflicting_sources", field, "Only one of base64, url or file is allowed"}
+	}
+
+	return nil
+}
+
+// weightedRequest contains the parameters of a /weighted call
+type weightedRequest struct {
+	Image       *fileSource     `json:"image"`
+	Width       float64         `json:"w"`
+	Height      float64         `json:"h"`
+	MinAspect   float64         `json:"minaspect"`
+	MaxAspect   float64         `json:"maxaspect"`
+	Aspect      float64         `json:"aspect"`
+	Padding     imgrect.Padding `json:"padding"`
+	Regions     []*searchRegion `json:"regions"`
+	KeepOut     [][]float64     `json:"keepout"`
+	Mask        *fileSource     `json:"mask"`
+	Font        *fileSource     `json:"font"`
+	FontSize    float64         `json:"fontsize"`
+	Fit         bool            `json:"fit"`
+	MinFontSize float64         `json:"minfontsize"`
+	MaxFontSize float64         `json:"maxfontsize"`
+	Text        string          `json:"text"`
+	MaxLines    int             `json:"maxlines"`
+	LineHeight  float64         `json:"lineheight"`
+	Align       string          `json:"align"`
+	N           int             `json:"n"`
+	Min         int             `json:"min"`
+	Detector    string          `json:"detector"`
+	Composition string          `json:"composition"`
+	Gravity     string          `json:"gravity"`
+	Snap        float64         `json:"snap"`
+	Faces       string          `json:"faces"`
+}
+
+// searchRegion is a region of a /weighted request, its size and amount
+// default to those of the request
+type searchRegion struct {
+	Bounds []float64 `json:"bounds"`
+	Width  float64   `json:"w"`
+	Height float64   `json:"h"`
+	N      int       `json:"n"`
+}
+
+// regions returns the validated regions to search, if any
+func (req *weightedRequest) regions() []*imgrect.Region {
+	if len(req.Regions) == 0 {
+		return nil
+	}
+
+	bounds := make([][]float64, len(req.Regions))
+	for i, r := range req.Regions {
+		bounds[i] = r.Bounds
+	}
+
+	regions := make([]*imgrect.Region, len(req.Regions))
+	for i, rect := range percentRectangles(bounds) {
+		r := req.Regions[i]
+		regions[i] = &imgrect.Region{
+			Bounds:    rect,
+			MinWidth:  r.Width,
+			MinHeight: r.Height,
+			Amount:    r.N,
+		}
+	}
+
+	return regions
+}
+
+// text returns the options of the text to fit, font has to be opened
+// from req.Font
+func (req *weightedRequest) text(font io.Reader) *imgrect.TextOptions {
+	if font == nil {
+		return nil
+	}
+
+	return &imgrect.TextOptions{
+		Font:       font,
+		Size:       req.FontSize,
+		Text:       req.Text,
+		MaxLines:   req.MaxLines,
+		LineHeight: req.LineHeight,
+		Align:      req.Align,
+		Fit:        req.Fit,
+		MinSize:    req.MinFontSize,
+		MaxSize:    req.MaxFontSize,
+	}
+}
+
+// font returns the source of the font, if any
+func (req *weightedRequest) font() *fileSource {
+	if req.Font != nil {
+		req.Font.media = fontMedia
+	}
+
+	return req.Font
+}
+
+// params returns the parameters of the request without its files,
+// defaults are filled in
+func (req *weightedRequest) params() *weightedRequest {
+	params := *req
+	params.Image = nil
+	params.Font = nil
+	params.Mask = nil
+	params.N = req.amount()
+	if params.Detector == "" {
+		params.Detector = "canny"
+	}
+
+	if params.Composition == "" {
+		params.Composition = imgrect.CompositionCenter
+	}
+
+	return &params
+}
+
+// cacheKey identifies the result of the request. Its files are loaded until
+// ctx is done, errors are reported on their field.
+func (req *weightedRequest) cacheKey(ctx context.Context) (string, *handlerError) {
+	files := []*fileSource{req.Image, req.font(), req.Mask}
+	for i, field := range []string{"image", "font", "mask"} {
+		if files[i] == nil {
+			continue
+		}
+
+		if _, err := files[i].load(ctx); err != nil {
+			return "", sourceError(field, err)
+		}
+	}
+
+	key, err := cacheKey(ctx, "weighted", req.params(), files...)
+	if err != nil {
+		return "", &handlerError{err: err}
+	}
+
+	return key, nil
+}
+
+// detector used to find busy pixels
+func (req *weightedRequest) detector() canny.Detector {
+	if d, ok := canny.GetDetector(req.Detector); ok {
+		return d
+	}
+
+	return canny.DefaultDetector
+}
+
+// aspects returns the bounds of the width / height ratio, 0 when not
+// bounded
+func (req *weightedRequest) aspects() (float64, float64) {
+	if req.Aspect != 0 {
+		return req.Aspect, req.Aspect
+	}
+
+	return req.MinAspect, req.MaxAspect
+}
+
+// amount of rectangles to return
+func (req *weightedRequest) amount() int {
+	if req.N == 0 {
+		return cfg.Amount
+	}
+
+	return req.N
+}
+
+func (req *weightedRequest) validate() *requestError {
+	if err := req.Image.validate("image", true); err != nil {
+		return err
+	}
+
+	if err := req.Font.validate("font", false); err != nil {
+		return err
+	}
+
+	if err := req.Mask.validate("mask", false); err != nil {
+		return err
+	}
+
+	if len(req.Regions) > cfg.MaxBounds {
+		return &requestError{"too_many_regions", "regions", fmt.Sprintf("At most %d regions are allowed", cfg.MaxBounds)}
+	}
+
+	for i, r := range req.Regions {
+		field := fmt.Sprintf("regions[%d]", i)
+		switch {
+		case r == nil:
+			return &requestError{"required", field, "Expected a region"}
+		case r.Width < 0:
+			return &requestError{"out_of_range", field + ".w", "Must not be negative"}
+		case r.Height < 0:
+			return &requestError{"out_of_range", field + ".h", "Must not be negative"}
+		case r.N < 0 || r.N > cfg.MaxAmount:
+			return &requestError{"out_of_range", field + ".n", fmt.Sprintf("Must be between 1 and %d", cfg.MaxAmount)}
+		}
+
+		if err := validateRect(field+".bounds", r.Bounds); err != nil {
+			return err
+		}
+	}
+
+	if len(req.KeepOut) > cfg.MaxBounds {
+		return &requestError{"too_many_bounds", "keepout", fmt.Sprintf("At most %d keep out rectangles are allowed", cfg.MaxBounds)}
+	}
+
+	if err := validateRects("keepout", req.KeepOut); err != nil {
+		return err
+	}
+
+	switch {
+	case req.Width < 0:
+		return &requestError{"out_of_range", "w", "Must not be negative"}
+	case req.Height < 0:
+		return &requestError{"out_of_range", "h", "Must not be negative"}
+	case req.MinAspect < 0:
+		return &requestError{"out_of_range", "minaspect", "Must not be negative"}
+	case req.MaxAspect < 0:
+		return &requestError{"out_of_range", "maxaspect", "Must not be negative"}
+	case req.MaxAspect != 0 && req.MaxAspect < req.MinAspect:
+		return &requestError{"out_of_range", "maxaspect", "Must not be smaller than minaspect"}
+	case req.Aspect < 0:
+		return &requestError{"out_of_range", "aspect", "Must not be negative"}
+	case req.Aspect != 0 && (req.MinAspect != 0 || req.MaxAspect != 0):
+		return &requestError{"conflicting_params", "aspect", "Can not be combined with minaspect or maxaspect"}
+	case req.FontSize < 0:
+		return &requestError{"out_of_range", "fontsize", "Must not be negative"}
+	case req.N < 0 || req.N > cfg.MaxAmount:
+		return &requestError{"out_of_range", "n", fmt.Sprintf("Must be between 1 and %d", cfg.MaxAmount)}
+	case req.Min < 0:
+		return &requestError{"out_of_range", "min", "Must not be negative"}
+	case req.Min > req.amount():
+		return &requestError{"out_of_range", "min", "Must not be larger than n"}
+	}
+
+	if _, ok := canny.GetDetector(req.Detector); req.Detector != "" && !ok {
+		return &requestError{"invalid_choice", "detector", "Must be one of " + strings.Join(canny.DetectorNames(), ", ")}
+	}
+
+	if req.Fit {
+		switch {
+		case req.Font == nil:
+			return &requestError{"required", "font", "Is required to fit text"}
+		case req.MinFontSize <= 0:
+			return &requestError{"out_of_range", "minfontsize", "Must be positive"}
+		case req.MaxFontSize < req.MinFontSize:
+			return &requestError{"out_of_range", "maxfontsize", "Must not be smaller than minfontsize"}
+		}
+	}
+
+	switch {
+	case req.MaxLines < 0 || req.MaxLines > imgrect.MaxTextLines:
+		return &requestError{"out_of_range", "maxlines", fmt.Sprintf("Must be between 1 and %d", imgrect.MaxTextLines)}
+	case req.LineHeight < 0:
+		return &requestError{"out_of_range", "lineheight", "Must not be negative"}
+	}
+
+	switch req.Align {
+	case "", imgrect.AlignLeft, imgrect.AlignCenter, imgrect.AlignRight:
+	default:
+		return &requestError{"invalid_choice", "align", "Must be one of left, center, right"}
+	}
+
+	switch req.Composition {
+	case "", imgrect.CompositionCenter, imgrect.CompositionThirds:
+	default:
+		return &requestError{"invalid_choice", "composition", "Must be one of center, thirds"}
+	}
+
+	if req.Gravity != "" && !imgrect.IsGravity(req.Gravity) {
+		return &requestError{"invalid_choice", "gravity", "Must be one of " + strings.Join(imgrect.GravityNames(), ", ")}
+	}
+
+	switch {
+	case req.Snap < 0:
+		return &requestError{"out_of_range", "snap", "Must not be negative"}
+	case req.Snap > 0 && req.Gravity == "":
+		return &requestError{"required", "gravity", "Is required to snap"}
+	}
+
+	switch req.Faces {
+	case "", imgrect.FacesDrop, imgrect.FacesPenalize:
+	default:
+		return &requestError{"invalid_choice", "faces", "Must be one of drop, penalize"}
+	}
+
+	p := req.Padding
+	if p.Top < 0 || p.Right < 0 || p.Bottom < 0 || p.Left < 0 {
+		return &requestError{"out_of_range", "padding", "Must not be negative"}
+	}
+
+	return nil
+}
+
+// boundedRequest contains the parameters of a /bounded call
+type boundedRequest struct {
+	Image  *fileSource `json:"image"`
+	Bounds [][]float64 `json:"bounds"`
+}
+
+func (req *boundedRequest) validate() *requestError {
+	if err := req.Image.validate("image", true); err != nil {
+		return err
+	}
+
+	if len(req.Bounds) < 2 {
+		return &requestError{"too_few_bounds", "bounds", "At least 2 bounds are required"}
+	}
+
+	if len(req.Bounds) > cfg.MaxBounds {
+		return &requestError{"too_many_bounds", "bounds", fmt.Sprintf("At most %d bounds are allowed", cfg.MaxBounds)}
+	}
+
+	return validateRects("bounds", req.Bounds)
+}
+
+func (req *boundedRequest) rects() []*imgrect.PercentRectangle {
+	return percentRectangles(req.Bounds)
+}
+
+// validateRects checks the x1,y1,x2,y2 rectangles of field
+func validateRects(field string, rects [][]float64) *requestError {
+	for i := range rects {
+		if err := validateRect(fmt.Sprintf("%s[%d]", field, i), rects[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRect checks the x1,y1,x2,y2 rectangle of field
+func validateRect(field string, rect []float64) *requestError {
+	if len(rect) != 4 {
+		return &requestError{"invalid_bound", field, "Expected x1,y1,x2,y2"}
+	}
+
+	for i, v := range rect {
+		if v < 0 {
+			return &requestError{"invalid_bound", field + "." + boundComponents[i], "Must not be negative"}
+		}
+	}
+
+	return nil
+}
+
+// percentRectangles converts validated x1,y1,x2,y2 rectangles
+func percentRectangles(rects [][]float64) []*imgrect.PercentRectangle {
+	converted := make([]*imgrect.PercentRectangle, len(rects))
+	for i, r := range rects {
+		converted[i] = imgrect.NewPercentRectangle(r[0], r[1], r[2], r[3])
+	}
+
+	return converted
+}
+
+// isJSONRequest reports whether the request body is application/json
+func isJSONRequest(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// decodeJSONRequest decodes the request body into v
+func decodeJSONRequest(r *http.Request, v interface{}) *requestError {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var merr *http.MaxBytesError
+		if errors.As(err, &merr) {
+			return bodyError("", err)
+		}
+
+		if err, ok := err.(*json.UnmarshalTypeError); ok {
+			return &requestError{"invalid_type", err.Field, "Expected " + err.Type.String()}
+		}
+
+		return &requestError{"invalid_json", "", "Invalid JSON body: " + err.Error()}
+	}
+
+	return nil
+}